@@ -2,14 +2,17 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
-	"os"
 	"regexp"
 	"strings"
 	"sync"
+	"text/template"
+	"time"
 
 	"github.com/satori/go.uuid"
 	"github.com/elazarl/goproxy"
@@ -23,15 +26,46 @@ type FindResponse struct {
 	Requests []Request `json:"requests"`
 }
 
+type UnmatchedResponse struct {
+	Requests []JournalEntry `json:"requests"`
+}
+
 type Server struct {
 	Proxy *goproxy.ProxyHttpServer
 
 	expectations []*Expectation
 	mutex        sync.RWMutex
 	requestStore RequestStore
+	storeOnce    sync.Once
+	conns        clientConns
+	recorder     Recorder
+	journal      Journal
+	unmatched    Journal
+	notifier     requestNotifier
+	events       eventBroker
+
+	// Prefer the newest rather than the oldest of equal priority matching
+	// expectations
+	newestFirst bool
+
+	// Describe the closest expectations in the 404 for unmatched requests
+	nearMissesInResponse bool
+
+	// Session IDs created through the control API, and the header proxied
+	// requests name theirs in
+	sessions      map[string]bool
+	sessionHeader string
+
+	// How long hang_after_headers faults hang for, defaultFaultHangTimeout
+	// if zero
+	faultHangTimeout time.Duration
 }
 
-var requestsPathExp = regexp.MustCompile(`/expectations/[a-f0-9\-]+/requests`)
+var (
+	requestsPathExp    = regexp.MustCompile(`/expectations/[a-f0-9\-]+/requests`)
+	expectationPathExp = regexp.MustCompile(`^/expectations/[a-f0-9\-]+$`)
+	sessionPathExp     = regexp.MustCompile(`^/sessions/[a-f0-9\-]+$`)
+)
 
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "GET" && requestsPathExp.MatchString(r.URL.Path) {
@@ -39,6 +73,30 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if expectationPathExp.MatchString(r.URL.Path) {
+		switch r.Method {
+		case "GET":
+			s.getExpectation(w, r)
+		case "PUT", "PATCH":
+			s.updateExpectation(w, r)
+		case "DELETE":
+			s.deleteExpectation(w, r)
+		default:
+			http.Error(w, "everdeen: Method Not Allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	if sessionPathExp.MatchString(r.URL.Path) {
+		if r.Method != "DELETE" {
+			http.Error(w, "everdeen: Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		s.deleteSession(w, r)
+		return
+	}
+
 	switch r.URL.Path {
 	case "/ping":
 		fmt.Fprint(w, "PONG")
@@ -59,6 +117,74 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 
 		s.findRequests(w, r)
+	case "/sessions":
+		if r.Method != "POST" {
+			http.Error(w, "everdeen: Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		s.createSession(w, r)
+	case "/requests/unmatched":
+		switch r.Method {
+		case "GET":
+			s.listUnmatchedRequests(w, r)
+		case "DELETE":
+			s.resetUnmatchedRequests(w, r)
+		default:
+			http.Error(w, "everdeen: Method Not Allowed", http.StatusMethodNotAllowed)
+		}
+	case "/verify":
+		if r.Method != "POST" {
+			http.Error(w, "everdeen: Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		s.verify(w, r)
+	case "/verify/order":
+		if r.Method != "POST" {
+			http.Error(w, "everdeen: Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		s.verifyOrder(w, r)
+	case "/events":
+		if r.Method != "GET" {
+			http.Error(w, "everdeen: Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		s.streamEvents(w, r)
+	case "/har":
+		if r.Method != "GET" {
+			http.Error(w, "everdeen: Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		s.exportHAR(w, r)
+	case "/wait":
+		if r.Method != "POST" {
+			http.Error(w, "everdeen: Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		s.wait(w, r)
+	case "/recordings":
+		switch r.Method {
+		case "GET":
+			s.exportRecordings(w, r)
+		case "DELETE":
+			s.resetRecordings(w, r)
+		default:
+			http.Error(w, "everdeen: Method Not Allowed", http.StatusMethodNotAllowed)
+		}
+	case "/recordings/start", "/recordings/stop":
+		if r.Method != "POST" {
+			http.Error(w, "everdeen: Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		s.recorder.SetEnabled(r.URL.Path == "/recordings/start")
+		io.WriteString(w, "OK")
 	case "/reset/all":
 		if r.Method != "DELETE" {
 			http.Error(w, "everdeen: Method Not Allowed", http.StatusMethodNotAllowed)
@@ -75,9 +201,6 @@ func (s *Server) findRequests(w http.ResponseWriter, r *http.Request) {
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
 
-	s.requestStore.mutex.RLock()
-	defer s.requestStore.mutex.RUnlock()
-
 	expUuid, err := uuid.FromString(strings.Split(r.URL.Path, "/")[2])
 
 	if uuid.Equal(expUuid, uuid.Nil) || err != nil {
@@ -91,24 +214,87 @@ func (s *Server) findRequests(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if found, err := s.requestStore.Where(exp.Uuid); err != nil {
+	filter, err := parseRequestFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("everdeen: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	if found, err := s.store().Where(exp.Uuid); err != nil {
+		http.Error(w, fmt.Sprintf("everdeen: %s", err), http.StatusInternalServerError)
+	} else if err := json.NewEncoder(w).Encode(FindResponse{Requests: filter.Apply(found)}); err != nil {
 		http.Error(w, fmt.Sprintf("everdeen: %s", err), http.StatusInternalServerError)
-	} else if err := json.NewEncoder(w).Encode(FindResponse{Requests: found}); err != nil {
+	}
+}
+
+func (s *Server) listUnmatchedRequests(w http.ResponseWriter, r *http.Request) {
+	session, ok := s.sessionParam(w, r)
+	if !ok {
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(UnmatchedResponse{Requests: s.unmatched.SessionEntries(session)}); err != nil {
 		http.Error(w, fmt.Sprintf("everdeen: %s", err), http.StatusInternalServerError)
+		log.Printf("ERROR: %v", err)
+	}
+}
+
+func (s *Server) resetUnmatchedRequests(w http.ResponseWriter, r *http.Request) {
+	session, ok := s.sessionParam(w, r)
+	if !ok {
+		return
 	}
+
+	s.unmatched.Remove(func(entry JournalEntry) bool {
+		return session == "" || entry.Session == session
+	})
+
+	io.WriteString(w, "OK")
 }
 
 func (s *Server) listExectations(w http.ResponseWriter, r *http.Request) {
+	session, ok := s.sessionParam(w, r)
+	if !ok {
+		return
+	}
+
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
 
-	if err := json.NewEncoder(w).Encode(s.expectations); err != nil {
+	expectations := s.expectations
+	if session != "" {
+		expectations = []*Expectation{}
+		for _, e := range s.expectations {
+			if e.Session == session {
+				expectations = append(expectations, e)
+			}
+		}
+	}
+
+	if err := json.NewEncoder(w).Encode(expectations); err != nil {
 		http.Error(w, fmt.Sprintf("everdeen: %s", err), http.StatusInternalServerError)
 		log.Printf("ERROR: %v", err)
 	}
 }
 
+func (s *Server) exportRecordings(w http.ResponseWriter, r *http.Request) {
+	if err := s.recorder.Export(w); err != nil {
+		http.Error(w, fmt.Sprintf("everdeen: %s", err), http.StatusInternalServerError)
+		log.Printf("ERROR: %v", err)
+	}
+}
+
+func (s *Server) resetRecordings(w http.ResponseWriter, r *http.Request) {
+	s.recorder.Reset()
+	io.WriteString(w, "OK")
+}
+
 func (s *Server) createExpectations(w http.ResponseWriter, r *http.Request) {
+	session, ok := s.sessionParam(w, r)
+	if !ok {
+		return
+	}
+
 	var request CreateExpectationsRequest
 	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
 		http.Error(w, fmt.Sprintf("everdeen: %s", err), http.StatusInternalServerError)
@@ -123,33 +309,244 @@ func (s *Server) createExpectations(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	for _, expectation := range expectations {
+		expectation.Session = session
+	}
+
+	s.addExpectations(expectations)
+
+	if err := json.NewEncoder(w).Encode(expectations); err != nil {
+		http.Error(w, fmt.Sprintf("everdeen: %s", err), http.StatusInternalServerError)
+		log.Printf("ERROR: %v", err)
+	}
+}
+
+func (s *Server) addExpectations(expectations []*Expectation) {
 	s.mutex.Lock()
+	defer s.mutex.Unlock()
 
 	for _, expectation := range expectations {
 		//User shouldn't be setting and is handled by server
 		expectation.Uuid = uuid.NewV4()
 		s.expectations = append(s.expectations, expectation)
 	}
+}
+
+// pathExpectationUuid parses the expectation UUID out of a
+// `/expectations/{uuid}` path.
+func pathExpectationUuid(r *http.Request) uuid.UUID {
+	expUuid, err := uuid.FromString(strings.Split(r.URL.Path, "/")[2])
+	if err != nil {
+		return uuid.Nil
+	}
+
+	return expUuid
+}
 
+func (s *Server) getExpectation(w http.ResponseWriter, r *http.Request) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	exp := s.findExpectationByUuid(pathExpectationUuid(r))
+	if exp == nil {
+		http.Error(w, "everdeen: Not Found", http.StatusNotFound)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(exp); err != nil {
+		http.Error(w, fmt.Sprintf("everdeen: %s", err), http.StatusInternalServerError)
+		log.Printf("ERROR: %v", err)
+	}
+}
+
+// updateExpectation replaces an expectation with the one in the request
+// body for a PUT, or with the fields in the request body merged over it for
+// a PATCH. The UUID, matches so far and stored requests are kept.
+func (s *Server) updateExpectation(w http.ResponseWriter, r *http.Request) {
+	expUuid := pathExpectationUuid(r)
+
+	// The body is read before taking the lock so that a slow client can't
+	// hold up the proxy
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("everdeen: %s", err), http.StatusBadRequest)
+		log.Printf("ERROR: %v", err)
+		return
+	}
+
+	patch := map[string]json.RawMessage{}
+	if r.Method == "PATCH" {
+		if err := json.Unmarshal(body, &patch); err != nil {
+			http.Error(w, fmt.Sprintf("everdeen: %s", err), http.StatusBadRequest)
+			log.Printf("ERROR: %v", err)
+			return
+		}
+	}
+
+	s.mutex.RLock()
+	i := s.expectationIndex(expUuid)
+	var existing *Expectation
+	if i != -1 {
+		existing = s.expectations[i]
+	}
+	s.mutex.RUnlock()
+
+	if existing == nil {
+		http.Error(w, "everdeen: Not Found", http.StatusNotFound)
+		return
+	}
+
+	if r.Method == "PATCH" {
+		if body, err = patchExpectation(existing, patch); err != nil {
+			http.Error(w, fmt.Sprintf("everdeen: %s", err), http.StatusBadRequest)
+			log.Printf("ERROR: %v", err)
+			return
+		}
+	}
+
+	request := CreateExpectationsRequest{Expectations: make([]Expectation, 1)}
+	if err := json.Unmarshal(body, &request.Expectations[0]); err != nil {
+		http.Error(w, fmt.Sprintf("everdeen: %s", err), http.StatusBadRequest)
+		log.Printf("ERROR: %v", err)
+		return
+	}
+
+	expectations, err := prepareExpectations(request)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("everdeen: %s", err), http.StatusBadRequest)
+		log.Printf("ERROR: %v", err)
+		return
+	}
+
+	expectation := expectations[0]
+
+	s.mutex.Lock()
+	i = s.expectationIndex(expUuid)
+	if i == -1 {
+		s.mutex.Unlock()
+		http.Error(w, "everdeen: Not Found", http.StatusNotFound)
+		return
+	}
+
+	if s.expectations[i] != existing {
+		s.mutex.Unlock()
+		http.Error(w, "everdeen: expectation was changed while being updated", http.StatusConflict)
+		return
+	}
+
+	expectation.Uuid = existing.Uuid
+	expectation.Session = existing.Session
+	expectation.source = existing.source
+
+	existing.mutex.RLock()
+	expectation.Matches = existing.Matches
+	existing.mutex.RUnlock()
+
+	s.expectations[i] = expectation
 	s.mutex.Unlock()
 
-	if err := json.NewEncoder(w).Encode(expectations); err != nil {
+	if err := json.NewEncoder(w).Encode(expectation); err != nil {
 		http.Error(w, fmt.Sprintf("everdeen: %s", err), http.StatusInternalServerError)
 		log.Printf("ERROR: %v", err)
 	}
 }
 
+// patchExpectation merges the top level fields of a JSON patch over the JSON
+// of an existing expectation.
+func patchExpectation(existing *Expectation, patch map[string]json.RawMessage) ([]byte, error) {
+	original, err := json.Marshal(existing)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(original, &fields); err != nil {
+		return nil, err
+	}
+
+	for key, value := range patch {
+		fields[key] = value
+	}
+
+	return json.Marshal(fields)
+}
+
+// deleteExpectation removes an expectation, and its stored requests too
+// when `?delete_requests=true` is given.
+func (s *Server) deleteExpectation(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+
+	i := s.expectationIndex(pathExpectationUuid(r))
+	if i == -1 {
+		s.mutex.Unlock()
+		http.Error(w, "everdeen: Not Found", http.StatusNotFound)
+		return
+	}
+
+	expectation := s.expectations[i]
+	s.expectations = append(s.expectations[:i:i], s.expectations[i+1:]...)
+
+	s.mutex.Unlock()
+
+	if r.URL.Query().Get("delete_requests") == "true" {
+		if err := s.store().Delete(expectation.Uuid); err != nil {
+			http.Error(w, fmt.Sprintf("everdeen: %s", err), http.StatusInternalServerError)
+			log.Printf("ERROR: %v", err)
+			return
+		}
+	}
+
+	io.WriteString(w, "OK")
+}
+
 func prepareExpectations(request CreateExpectationsRequest) ([]*Expectation, error) {
 	expectations := []*Expectation{}
 
-	for _, e := range request.Expectations {
-		prepareCriteria(e.RequestCriteria)
+	for i := range request.Expectations {
+		e := &request.Expectations[i]
+
+		if err := prepareCriteria(e.RequestCriteria); err != nil {
+			return nil, err
+		}
 
-		// We expose `Matches` for the `GET /expectations` endpoint
-		// but do not want the client to be able to set it.
+		if err := prepareRespondWith(&e.RespondWith); err != nil {
+			return nil, err
+		}
+
+		for i := range e.RespondWithSequence {
+			if err := prepareRespondWith(&e.RespondWithSequence[i]); err != nil {
+				return nil, err
+			}
+		}
+
+		if err := e.Fault.Validate(); err != nil {
+			return nil, err
+		}
+
+		switch e.SequenceExhausted {
+		case "":
+			e.SequenceExhausted = SequenceExhaustedRepeatLast
+		case SequenceExhaustedRepeatLast, SequenceExhaustedCycle, SequenceExhaustedFallThrough:
+		default:
+			return nil, fmt.Errorf("unknown sequence_exhausted behaviour %q", e.SequenceExhausted)
+		}
+
+		if e.TTLSeconds < 0 {
+			return nil, fmt.Errorf("ttl_seconds cannot be negative")
+		}
+
+		if e.TTLSeconds > 0 {
+			expiresAt := time.Now().UTC().Add(time.Duration(e.TTLSeconds) * time.Second)
+			e.ExpiresAt = &expiresAt
+			e.TTLSeconds = 0
+		}
+
+		// We expose `Matches` and `Expired` for the `GET /expectations`
+		// endpoint but do not want the client to be able to set them.
 		e.Matches = 0
+		e.Expired = false
 
-		expectations = append(expectations, &e)
+		expectations = append(expectations, e)
 	}
 
 	return expectations, nil
@@ -157,10 +554,36 @@ func prepareExpectations(request CreateExpectationsRequest) ([]*Expectation, err
 
 func prepareCriteria(c Criteria) error {
 	for _, criterion := range c {
+		if criterion == nil {
+			return errors.New("criteria must not be null")
+		}
+
+		switch criterion.Type {
+		case CriteriaTypeAllOf, CriteriaTypeAnyOf, CriteriaTypeNoneOf:
+			if len(criterion.Criteria) == 0 {
+				return fmt.Errorf("%s criteria must contain at least one nested criterion", criterion.Type)
+			}
+
+			if err := prepareCriteria(criterion.Criteria); err != nil {
+				return err
+			}
+
+			continue
+		}
+
 		if criterion.MatchType == "" {
 			criterion.MatchType = MatchTypeExact
 		}
 
+		matchTypes, ok := criteriaMatchTypes[criterion.Type]
+		if !ok {
+			return fmt.Errorf("unknown criteria type %q", criterion.Type)
+		}
+
+		if !supportsMatchType(matchTypes, criterion.MatchType) {
+			return fmt.Errorf("match type %q is not supported by %s criteria", criterion.MatchType, criterion.Type)
+		}
+
 		if criterion.MatchType == MatchTypeRegex {
 			var err error
 			criterion.regexp, err = regexp.Compile(criterion.Value)
@@ -169,23 +592,110 @@ func prepareCriteria(c Criteria) error {
 				return err
 			}
 		}
+
+		if criterion.MatchType == MatchTypeJSONEqual || criterion.MatchType == MatchTypeJSONContains {
+			var err error
+			criterion.jsonValue, err = decodeJSON([]byte(criterion.Value))
+
+			if err != nil {
+				return fmt.Errorf("invalid JSON value for %s criteria: %s", criterion.MatchType, err)
+			}
+		}
+
+		if criterion.Type == CriteriaTypeJSONPath {
+			var err error
+			criterion.jsonPath, err = compileJSONPath(criterion.Key)
+
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func supportsMatchType(matchTypes []MatchType, matchType MatchType) bool {
+	for _, m := range matchTypes {
+		if m == matchType {
+			return true
+		}
+	}
+
+	return false
+}
+
+func prepareRespondWith(rw *RespondWith) error {
+	if rw.Delay != nil {
+		if rw.Delay.Distribution == "" {
+			rw.Delay.Distribution = rw.Delay.inferDistribution()
+		}
+
+		if err := rw.Delay.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if !rw.Templated {
+		return nil
+	}
+
+	if rw.BodyEncoding == BodyEncodingBase64 {
+		return errors.New("templated responses cannot have a base64 encoded body")
+	}
+
+	var err error
+	rw.bodyTemplate, err = parseResponseTemplate("body", rw.Body)
+	if err != nil {
+		return err
+	}
+
+	rw.headerTemplates = make(map[string]*template.Template, len(rw.Headers))
+	for key, value := range rw.Headers {
+		rw.headerTemplates[key], err = parseResponseTemplate(key, value)
+		if err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
+// resetAll removes every expectation, stored request and journaled request,
+// or with `?session=` only those of the session.
 func (s *Server) resetAll(w http.ResponseWriter, r *http.Request) {
-	s.mutex.RLock()
-	defer s.mutex.RUnlock()
+	session, ok := s.sessionParam(w, r)
+	if !ok {
+		return
+	}
+
+	if session != "" {
+		s.mutex.Lock()
+		removed := s.resetSession(session)
+		s.mutex.Unlock()
 
-	s.expectations = nil
+		if err := s.deleteStoredRequests(removed); err != nil {
+			http.Error(w, fmt.Sprintf("everdeen: %s", err), http.StatusInternalServerError)
+			log.Printf("ERROR: %v", err)
+			return
+		}
+
+		io.WriteString(w, "OK")
+		return
+	}
+
+	s.mutex.Lock()
 
 	// Re-initialize so the response to list expectations is not null
 	s.expectations = make([]*Expectation, 0, 0)
 
-	// Ensure to delete the directory of request stores
-	if err := os.RemoveAll(*requestBaseStore); err != nil {
-		log.Printf("Error deleting the request store directory %s", err)
+	s.journal.Reset()
+	s.unmatched.Reset()
+
+	s.mutex.Unlock()
+
+	if err := s.store().Reset(); err != nil {
+		log.Printf("Error resetting the request store %s", err)
 		http.Error(w, fmt.Sprintf("everdeen: %s", err), http.StatusInternalServerError)
 		return
 	}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+type DelayDistribution string
+
+const (
+	DelayDistributionFixed   DelayDistribution = "fixed"
+	DelayDistributionUniform DelayDistribution = "uniform"
+	DelayDistributionNormal  DelayDistribution = "normal"
+)
+
+// Delay describes how long to wait before responding, all values are in
+// milliseconds.
+type Delay struct {
+	Distribution DelayDistribution `json:"distribution"`
+
+	// Used by the fixed distribution
+	Milliseconds int `json:"ms"`
+
+	// Used by the uniform distribution
+	MinMilliseconds int `json:"min_ms"`
+	MaxMilliseconds int `json:"max_ms"`
+
+	// Used by the normal distribution
+	MeanMilliseconds   int `json:"mean_ms"`
+	StdDevMilliseconds int `json:"stddev_ms"`
+}
+
+// inferDistribution picks the distribution from the fields set, for delays
+// that don't give one.
+func (d *Delay) inferDistribution() DelayDistribution {
+	switch {
+	case d.MinMilliseconds != 0 || d.MaxMilliseconds != 0:
+		return DelayDistributionUniform
+	case d.MeanMilliseconds != 0 || d.StdDevMilliseconds != 0:
+		return DelayDistributionNormal
+	}
+
+	return DelayDistributionFixed
+}
+
+func (d *Delay) Validate() error {
+	fixed := d.Milliseconds != 0
+	uniform := d.MinMilliseconds != 0 || d.MaxMilliseconds != 0
+	normal := d.MeanMilliseconds != 0 || d.StdDevMilliseconds != 0
+
+	switch d.Distribution {
+	case DelayDistributionFixed:
+		if uniform || normal {
+			return fmt.Errorf("a fixed delay only uses ms")
+		}
+
+		if d.Milliseconds < 0 {
+			return fmt.Errorf("delay ms must not be negative")
+		}
+	case DelayDistributionUniform:
+		if fixed || normal {
+			return fmt.Errorf("a uniform delay only uses min_ms and max_ms")
+		}
+
+		if d.MinMilliseconds < 0 || d.MaxMilliseconds < d.MinMilliseconds {
+			return fmt.Errorf("delay min_ms must not be negative or greater than max_ms")
+		}
+	case DelayDistributionNormal:
+		if fixed || uniform {
+			return fmt.Errorf("a normal delay only uses mean_ms and stddev_ms")
+		}
+
+		if d.MeanMilliseconds < 0 || d.StdDevMilliseconds < 0 {
+			return fmt.Errorf("delay mean_ms and stddev_ms must not be negative")
+		}
+	default:
+		return fmt.Errorf("unknown delay distribution %q", d.Distribution)
+	}
+
+	return nil
+}
+
+// Duration picks how long to wait from the delay's distribution, a nil
+// delay doesn't wait at all.
+func (d *Delay) Duration() time.Duration {
+	if d == nil {
+		return 0
+	}
+
+	var ms float64
+
+	switch d.Distribution {
+	case DelayDistributionFixed:
+		ms = float64(d.Milliseconds)
+	case DelayDistributionUniform:
+		ms = float64(d.MinMilliseconds) + rand.Float64()*float64(d.MaxMilliseconds-d.MinMilliseconds)
+	case DelayDistributionNormal:
+		ms = float64(d.MeanMilliseconds) + rand.NormFloat64()*float64(d.StdDevMilliseconds)
+	}
+
+	if ms < 0 {
+		return 0
+	}
+
+	return time.Duration(ms * float64(time.Millisecond))
+}
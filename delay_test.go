@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDelayDuration(t *testing.T) {
+	var none *Delay
+	if d := none.Duration(); d != 0 {
+		t.Errorf("expected a nil delay to not wait but got %s", d)
+	}
+
+	fixed := &Delay{Distribution: DelayDistributionFixed, Milliseconds: 250}
+	if d := fixed.Duration(); d != 250*time.Millisecond {
+		t.Errorf("expected fixed delay of 250ms but got %s", d)
+	}
+
+	uniform := &Delay{Distribution: DelayDistributionUniform, MinMilliseconds: 100, MaxMilliseconds: 200}
+	for i := 0; i < 100; i++ {
+		if d := uniform.Duration(); d < 100*time.Millisecond || d > 200*time.Millisecond {
+			t.Fatalf("expected uniform delay between 100ms and 200ms but got %s", d)
+		}
+	}
+
+	normal := &Delay{Distribution: DelayDistributionNormal, MeanMilliseconds: 0, StdDevMilliseconds: 1000}
+	for i := 0; i < 100; i++ {
+		if d := normal.Duration(); d < 0 {
+			t.Fatalf("expected normal delay to never be negative but got %s", d)
+		}
+	}
+}
+
+func TestDelayValidate(t *testing.T) {
+	for _, d := range []Delay{
+		{Distribution: "exponential"},
+		{Distribution: DelayDistributionFixed, Milliseconds: -1},
+		{Distribution: DelayDistributionUniform, MinMilliseconds: 200, MaxMilliseconds: 100},
+		{Distribution: DelayDistributionNormal, MeanMilliseconds: 100, StdDevMilliseconds: -5},
+		{Distribution: DelayDistributionFixed, MinMilliseconds: 100, MaxMilliseconds: 200},
+		{Distribution: DelayDistributionUniform, Milliseconds: 100, MaxMilliseconds: 200},
+		{Distribution: DelayDistributionNormal, MeanMilliseconds: 100, MaxMilliseconds: 200},
+	} {
+		if err := d.Validate(); err == nil {
+			t.Errorf("expected an error validating %+v but got none", d)
+		}
+	}
+}
+
+func TestDelayInferDistribution(t *testing.T) {
+	for expected, d := range map[DelayDistribution]Delay{
+		DelayDistributionFixed:   {Milliseconds: 100},
+		DelayDistributionUniform: {MinMilliseconds: 100, MaxMilliseconds: 200},
+		DelayDistributionNormal:  {MeanMilliseconds: 100, StdDevMilliseconds: 10},
+	} {
+		if got := d.inferDistribution(); got != expected {
+			t.Errorf("expected %+v to be a %s delay but got %s", d, expected, got)
+		}
+	}
+
+	// Uniform delays can't have a max_ms less than min_ms
+	d := Delay{MinMilliseconds: 100}
+	d.Distribution = d.inferDistribution()
+	if err := d.Validate(); err == nil {
+		t.Errorf("expected an error validating %+v but got none", d)
+	}
+}
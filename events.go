@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/satori/go.uuid"
+)
+
+// eventBufferSize is how many events a slow /events client can fall behind
+// by before events are dropped for it.
+const eventBufferSize = 64
+
+var eventKeepAliveInterval = 15 * time.Second
+
+// Event describes a request handled by the proxy, once it has been
+// responded to.
+type Event struct {
+	Time            time.Time `json:"time"`
+	Method          string    `json:"method"`
+	URL             string    `json:"url"`
+	Matched         bool      `json:"matched"`
+	ExpectationUuid uuid.UUID `json:"expectation_uuid"`
+	Session         string    `json:"session,omitempty"`
+
+	// Faults are injected instead of a response, so have no status
+	Status      int   `json:"status,omitempty"`
+	Fault       Fault `json:"fault,omitempty"`
+	PassThrough bool  `json:"pass_through,omitempty"`
+
+	DurationMs        float64 `json:"duration_ms"`
+	UpstreamLatencyMs float64 `json:"upstream_latency_ms,omitempty"`
+}
+
+func newEvent(request Request) Event {
+	return Event{
+		Time:            request.Time,
+		Method:          request.Method,
+		URL:             request.URL,
+		Matched:         !uuid.Equal(request.ExpectationUuid, uuid.Nil),
+		ExpectationUuid: request.ExpectationUuid,
+		Session:         request.Session,
+	}
+}
+
+type eventFilter struct {
+	expectationUuid uuid.UUID
+	session         string
+}
+
+func (f eventFilter) match(e Event) bool {
+	if !uuid.Equal(f.expectationUuid, uuid.Nil) && !uuid.Equal(f.expectationUuid, e.ExpectationUuid) {
+		return false
+	}
+
+	return f.session == "" || f.session == e.Session
+}
+
+// eventBroker passes events on to the /events clients interested in them.
+type eventBroker struct {
+	subscribers map[chan Event]eventFilter
+	mutex       sync.RWMutex
+}
+
+func (b *eventBroker) subscribe(filter eventFilter) chan Event {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.subscribers == nil {
+		b.subscribers = map[chan Event]eventFilter{}
+	}
+
+	ch := make(chan Event, eventBufferSize)
+	b.subscribers[ch] = filter
+
+	return ch
+}
+
+func (b *eventBroker) unsubscribe(ch chan Event) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	delete(b.subscribers, ch)
+}
+
+// publish never blocks, events are dropped for clients not keeping up.
+func (b *eventBroker) publish(e Event) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	for ch, filter := range b.subscribers {
+		if !filter.match(e) {
+			continue
+		}
+
+		select {
+		case ch <- e:
+		default:
+			log.Printf("WARN: dropping event for slow /events client")
+		}
+	}
+}
+
+// publishEvent finishes off an event with how long the request took.
+func (s *Server) publishEvent(e Event) {
+	e.DurationMs = float64(time.Since(e.Time)) / float64(time.Millisecond)
+	s.events.publish(e)
+}
+
+// streamEvents sends the proxy's events as Server-Sent Events until the
+// client goes away.
+func (s *Server) streamEvents(w http.ResponseWriter, r *http.Request) {
+	session, ok := s.sessionParam(w, r)
+	if !ok {
+		return
+	}
+
+	filter := eventFilter{session: session}
+
+	if v := r.URL.Query().Get("expectation_uuid"); v != "" {
+		expUuid, err := uuid.FromString(v)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("everdeen: invalid expectation_uuid %q", v), http.StatusBadRequest)
+			return
+		}
+
+		filter.expectationUuid = expUuid
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "everdeen: streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	var closed <-chan bool
+	if notifier, ok := w.(http.CloseNotifier); ok {
+		closed = notifier.CloseNotify()
+	}
+
+	events := s.events.subscribe(filter)
+	defer s.events.unsubscribe(events)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	// Let the client know it's subscribed before any events arrive
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventKeepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case e := <-events:
+			data, err := json.Marshal(e)
+			if err != nil {
+				log.Printf("ERROR: %v", err)
+				continue
+			}
+
+			if _, err := fmt.Fprintf(w, "event: request\ndata: %s\n\n", data); err != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+
+		flusher.Flush()
+	}
+}
@@ -1,18 +1,27 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/tls"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"reflect"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/elazarl/goproxy"
+	"github.com/geckoboard/everdeen/certs"
 	"github.com/satori/go.uuid"
 )
 
@@ -539,83 +548,106 @@ func TestMethodExpectation(t *testing.T) {
 			},
 		},
 
-		// Responding With Custom Headers
+		// JSON Path Matcher (Exact)
 		{
 			expectations: []Expectation{
 				{
 					RequestCriteria: Criteria{
 						{
-							Type:  CriteriaTypeMethod,
-							Value: "GET",
+							Type:  CriteriaTypeJSONPath,
+							Key:   "$.customer.id",
+							Value: "cus_123",
 						},
 					},
 
 					RespondWith: RespondWith{
 						Status: 418,
 						Body:   "Proxy Response",
-						Headers: map[string]string{
-							"X-Custom-Header": "Yup it got set",
-						},
 					},
 				},
 			},
 			scenarios: []scenario{
 				{
 					request{
-						method: "GET",
+						method: "POST",
 						url:    websiteServer.URL,
+						body:   `{"amount": 100, "customer": {"id": "cus_123"}}`,
 					},
 					response{
 						status: 418,
 						body:   "Proxy Response",
-						headers: map[string]string{
-							"X-Custom-Header": "Yup it got set",
-						},
 					},
 				},
+				{
+					request{
+						method: "POST",
+						url:    websiteServer.URL,
+						body:   `{"customer":{"id":"cus_456"}}`,
+					},
+					blockedResponse,
+				},
+				{
+					request{
+						method: "POST",
+						url:    websiteServer.URL,
+						body:   "customer.id=cus_123",
+					},
+					blockedResponse,
+				},
 			},
 		},
 
-		// Responding With Binary Body (Base64 Encoded)
+		// JSON Path Matcher (Many / Exact)
 		{
 			expectations: []Expectation{
 				{
 					RequestCriteria: Criteria{
 						{
-							Type:  CriteriaTypeMethod,
-							Value: "GET",
+							Type:   CriteriaTypeJSONPath,
+							Key:    "$.items[*].quantity",
+							Values: []string{"1", "2"},
 						},
 					},
 
 					RespondWith: RespondWith{
-						Status:       418,
-						Body:         "SGVsbG8gV29ybGQ=",
-						BodyEncoding: BodyEncodingBase64,
+						Status: 418,
+						Body:   "Proxy Response",
 					},
 				},
 			},
 			scenarios: []scenario{
 				{
 					request{
-						method: "GET",
+						method: "POST",
 						url:    websiteServer.URL,
+						body:   `{"items": [{"quantity": 2}, {"quantity": 1}]}`,
 					},
 					response{
 						status: 418,
-						body:   "Hello World",
+						body:   "Proxy Response",
+					},
+				},
+				{
+					request{
+						method: "POST",
+						url:    websiteServer.URL,
+						body:   `{"items": [{"quantity": 2}]}`,
 					},
+					blockedResponse,
 				},
 			},
 		},
 
-		// Max Matches
+		// JSON Path Matcher (Regex)
 		{
 			expectations: []Expectation{
 				{
 					RequestCriteria: Criteria{
 						{
-							Type:  CriteriaTypeMethod,
-							Value: "GET",
+							Type:      CriteriaTypeJSONPath,
+							Key:       "$..email",
+							Value:     "@geckoboard\\.com$",
+							MatchType: MatchTypeRegex,
 						},
 					},
 
@@ -623,15 +655,14 @@ func TestMethodExpectation(t *testing.T) {
 						Status: 418,
 						Body:   "Proxy Response",
 					},
-
-					MaxMatches: 2,
 				},
 			},
 			scenarios: []scenario{
 				{
 					request{
-						method: "GET",
+						method: "POST",
 						url:    websiteServer.URL,
+						body:   `{"users": [{"email": "someone@example.com"}, {"email": "dev@geckoboard.com"}]}`,
 					},
 					response{
 						status: 418,
@@ -640,8 +671,39 @@ func TestMethodExpectation(t *testing.T) {
 				},
 				{
 					request{
-						method: "GET",
+						method: "POST",
+						url:    websiteServer.URL,
+						body:   `{"users": [{"email": "someone@example.com"}]}`,
+					},
+					blockedResponse,
+				},
+			},
+		},
+
+		// Body Matcher (JSON Equal)
+		{
+			expectations: []Expectation{
+				{
+					RequestCriteria: Criteria{
+						{
+							Type:      CriteriaTypeBody,
+							Value:     `{"name": "Katniss", "tags": ["archer", "tribute"], "age": 16}`,
+							MatchType: MatchTypeJSONEqual,
+						},
+					},
+
+					RespondWith: RespondWith{
+						Status: 418,
+						Body:   "Proxy Response",
+					},
+				},
+			},
+			scenarios: []scenario{
+				{
+					request{
+						method: "POST",
 						url:    websiteServer.URL,
+						body:   `{"age":16.0,"tags":["archer","tribute"],"name":"Katniss"}`,
 					},
 					response{
 						status: 418,
@@ -650,258 +712,2575 @@ func TestMethodExpectation(t *testing.T) {
 				},
 				{
 					request{
-						method: "GET",
+						method: "POST",
+						url:    websiteServer.URL,
+						body:   `{"age":16,"tags":["tribute","archer"],"name":"Katniss"}`,
+					},
+					blockedResponse,
+				},
+				{
+					request{
+						method: "POST",
+						url:    websiteServer.URL,
+						body:   `{"age":16,"tags":["archer","tribute"],"name":"Katniss","district":12}`,
+					},
+					blockedResponse,
+				},
+				{
+					request{
+						method: "POST",
 						url:    websiteServer.URL,
+						body:   `{"age":16,"tags":["archer","tribute"],"name":"Katniss"} garbage`,
 					},
 					blockedResponse,
 				},
 			},
 		},
 
-		// Pass Through
+		// Body Matcher (JSON Contains)
 		{
 			expectations: []Expectation{
 				{
 					RequestCriteria: Criteria{
 						{
-							Type:  CriteriaTypeMethod,
-							Value: "GET",
+							Type:      CriteriaTypeBody,
+							Value:     `{"user": {"name": "Katniss"}, "tags": ["tribute"]}`,
+							MatchType: MatchTypeJSONContains,
 						},
 					},
 
-					PassThrough: true,
+					RespondWith: RespondWith{
+						Status: 418,
+						Body:   "Proxy Response",
+					},
 				},
 			},
-
 			scenarios: []scenario{
 				{
 					request{
-						method: "GET",
+						method: "POST",
 						url:    websiteServer.URL,
+						body:   `{"tags": ["archer", "tribute"], "user": {"district": 12, "name": "Katniss"}}`,
 					},
 					response{
-						status: 200,
-						body:   "Got Through",
+						status: 418,
+						body:   "Proxy Response",
 					},
 				},
-
 				{
 					request{
 						method: "POST",
 						url:    websiteServer.URL,
+						body:   `{"tags": ["archer"], "user": {"district": 12, "name": "Katniss"}}`,
+					},
+					blockedResponse,
+				},
+				{
+					request{
+						method: "POST",
+						url:    websiteServer.URL,
+						body:   `not json`,
 					},
 					blockedResponse,
 				},
 			},
 		},
-	}
-
-	for i, tc := range testCases {
-		runTestCase(t, i, tc)
-	}
-}
-
-func runTestCase(t *testing.T, i int, tc testCase) {
-	proxy, proxyServer, proxyClient := buildProxy()
-	defer proxyServer.Close()
-
-	server := &Server{Proxy: proxy}
-	proxy.OnRequest().DoFunc(server.handleProxyRequest)
-
-	cer := CreateExpectationsRequest{tc.expectations}
-	createExpectations(t, server, &cer)
-
-	for idx, scenario := range tc.scenarios {
-		req, err := http.NewRequest(scenario.request.method, scenario.request.url, strings.NewReader(scenario.request.body))
-		if err != nil {
-			t.Fatalf("[%d - %d] error building request for scenario: %v", i, idx, err)
-		}
-
-		for key, value := range scenario.request.headers {
-			req.Header.Add(key, value)
-		}
-
-		resp, err := proxyClient.Do(req)
-		if err != nil {
-			t.Fatal(err)
-		}
-
-		if resp.StatusCode != scenario.response.status {
-			t.Errorf("[%d - %d] unexpected response status, expected: %d, got: %d", i, idx, scenario.response.status, resp.StatusCode)
-		}
-
-		bodyBytes, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			t.Fatalf("[%d - %d] error reading body: %v", idx, err)
-		}
-
-		body := string(bodyBytes)
-		if body != scenario.response.body {
-			t.Errorf("[%d - %d] unexpected response body, expected: %s, got: %s", i, idx, scenario.response.body, body)
-		}
-
-		for key, value := range scenario.response.headers {
-			got := resp.Header.Get(key)
-
-			if value != got {
-				t.Errorf("[%d - %d] unexpected value for header: %s, expected: %s, got: %s", i, idx, key, value, got)
-			}
-		}
-	}
-}
-
-func TestRequestMatchingExpectationUuid(t *testing.T) {
-	proxy, proxyServer, proxyClient := buildProxy()
-	defer proxyServer.Close()
-
-	server := &Server{Proxy: proxy}
-	proxy.OnRequest().DoFunc(server.handleProxyRequest)
 
-	//Setup an expectation
-	expectations := []Expectation{
+		// JSON Path Matcher (JSON Contains)
 		{
-			StoreMatchingRequests: true,
-			RequestCriteria: Criteria{
+			expectations: []Expectation{
 				{
-					Type:  CriteriaTypeMethod,
-					Value: "POST",
+					RequestCriteria: Criteria{
+						{
+							Type:      CriteriaTypeJSONPath,
+							Key:       "$.items[*]",
+							Value:     `{"sku": "bow"}`,
+							MatchType: MatchTypeJSONContains,
+						},
+					},
+
+					RespondWith: RespondWith{
+						Status: 418,
+						Body:   "Proxy Response",
+					},
 				},
+			},
+			scenarios: []scenario{
 				{
-					Type:  CriteriaTypeHost,
-					Value: "www.geckoboard.com",
+					request{
+						method: "POST",
+						url:    websiteServer.URL,
+						body:   `{"items": [{"sku": "arrow", "quantity": 12}, {"sku": "bow", "quantity": 1}]}`,
+					},
+					response{
+						status: 418,
+						body:   "Proxy Response",
+					},
 				},
 				{
-					Type:  CriteriaTypePath,
-					Value: "/hello-world",
+					request{
+						method: "POST",
+						url:    websiteServer.URL,
+						body:   `{"items": [{"sku": "arrow", "quantity": 12}]}`,
+					},
+					blockedResponse,
 				},
 			},
-			RespondWith: RespondWith{
-				Status:       http.StatusOK,
-				Body:         "Its me!!!",
-				BodyEncoding: BodyEncodingNone,
-			},
 		},
-	}
-
-	cer := CreateExpectationsRequest{expectations}
-	exp := createExpectations(t, server, &cer)
-
-	if uuid.Equal(exp[0].Uuid, uuid.Nil) {
-		t.Fatalf("Expected returned expectation to have uuid but it didn't: %#v", exp[0])
-	}
-
-	req, err := http.NewRequest("POST", "http://www.geckoboard.com/hello-world", strings.NewReader("Some Stuff"))
-	if err != nil {
-		t.Fatal(err)
-	}
-
-	req.Header.Add("X-Some-Header", "Hello World")
-	req.Header.Add("User-Agent", "Awesome User Agent")
-
-	_, err = proxyClient.Do(req)
-	if err != nil {
-		t.Fatal(err)
-	}
 
-	req, err = http.NewRequest("GET", "/expectations/"+exp[0].Uuid.String()+"/requests", nil)
-	if err != nil {
-		t.Fatal(err)
-	}
+		// Form Field Matcher (Exact / Regex)
+		{
+			expectations: []Expectation{
+				{
+					RequestCriteria: Criteria{
+						{
+							Type:  CriteriaTypeFormField,
+							Key:   "grant_type",
+							Value: "authorization_code",
+						},
+						{
+							Type:      CriteriaTypeFormField,
+							Key:       "code",
+							Value:     "^[a-z0-9]+$",
+							MatchType: MatchTypeRegex,
+						},
+					},
+
+					RespondWith: RespondWith{
+						Status: 418,
+						Body:   "Proxy Response",
+					},
+				},
+			},
+			scenarios: []scenario{
+				{
+					request{
+						method:  "POST",
+						url:     websiteServer.URL,
+						body:    "code=abc123&grant_type=authorization_code",
+						headers: map[string]string{"Content-Type": "application/x-www-form-urlencoded"},
+					},
+					response{
+						status: 418,
+						body:   "Proxy Response",
+					},
+				},
+				{
+					request{
+						method:  "POST",
+						url:     websiteServer.URL,
+						body:    "code=ABC-123&grant_type=authorization_code",
+						headers: map[string]string{"Content-Type": "application/x-www-form-urlencoded"},
+					},
+					blockedResponse,
+				},
+				{
+					request{
+						method:  "POST",
+						url:     websiteServer.URL,
+						body:    "code=abc123&state=%zz&grant_type=authorization_code",
+						headers: map[string]string{"Content-Type": "application/x-www-form-urlencoded"},
+					},
+					response{
+						status: 418,
+						body:   "Proxy Response",
+					},
+				},
+				{
+					request{
+						method:  "POST",
+						url:     websiteServer.URL,
+						body:    "code=abc123&grant_type=authorization_code",
+						headers: map[string]string{"Content-Type": "text/plain"},
+					},
+					blockedResponse,
+				},
+			},
+		},
+
+		// Form Field Matcher (Multipart / Many / Files)
+		{
+			expectations: []Expectation{
+				{
+					RequestCriteria: Criteria{
+						{
+							Type:   CriteriaTypeFormField,
+							Key:    "tags",
+							Values: []string{"b", "a"},
+						},
+						{
+							Type:  CriteriaTypeFormFileName,
+							Key:   "avatar",
+							Value: "katniss.png",
+						},
+						{
+							Type:      CriteriaTypeFormFileContentType,
+							Key:       "avatar",
+							Value:     "^image/",
+							MatchType: MatchTypeRegex,
+						},
+					},
+
+					RespondWith: RespondWith{
+						Status: 418,
+						Body:   "Proxy Response",
+					},
+				},
+			},
+			scenarios: []scenario{
+				{
+					request{
+						method:  "POST",
+						url:     websiteServer.URL,
+						body:    multipartBody("katniss.png", "image/png"),
+						headers: map[string]string{"Content-Type": "multipart/form-data; boundary=everdeen"},
+					},
+					response{
+						status: 418,
+						body:   "Proxy Response",
+					},
+				},
+				{
+					request{
+						method:  "POST",
+						url:     websiteServer.URL,
+						body:    multipartBody("katniss.txt", "text/plain"),
+						headers: map[string]string{"Content-Type": "multipart/form-data; boundary=everdeen"},
+					},
+					blockedResponse,
+				},
+			},
+		},
+
+		// Negated Criterion
+		{
+			expectations: []Expectation{
+				{
+					RequestCriteria: Criteria{
+						{
+							Type:   CriteriaTypePath,
+							Value:  "/health",
+							Negate: true,
+						},
+					},
+
+					RespondWith: RespondWith{
+						Status: 418,
+						Body:   "Proxy Response",
+					},
+				},
+			},
+			scenarios: []scenario{
+				{
+					request{
+						method: "GET",
+						url:    websiteServer.URL + "/users",
+					},
+					response{
+						status: 418,
+						body:   "Proxy Response",
+					},
+				},
+				{
+					request{
+						method: "GET",
+						url:    websiteServer.URL + "/health",
+					},
+					blockedResponse,
+				},
+			},
+		},
+
+		// Any Of / None Of Criteria
+		{
+			expectations: []Expectation{
+				{
+					RequestCriteria: Criteria{
+						{
+							Type: CriteriaTypeAnyOf,
+							Criteria: Criteria{
+								{
+									Type:  CriteriaTypeHost,
+									Value: "www.geckoboard.com",
+								},
+								{
+									Type:  CriteriaTypeHost,
+									Value: "app.geckoboard.com",
+								},
+							},
+						},
+						{
+							Type: CriteriaTypeNoneOf,
+							Criteria: Criteria{
+								{
+									Type:      CriteriaTypePath,
+									Value:     "^/admin",
+									MatchType: MatchTypeRegex,
+								},
+								{
+									Type: CriteriaTypeAllOf,
+									Criteria: Criteria{
+										{
+											Type:  CriteriaTypeMethod,
+											Value: "DELETE",
+										},
+										{
+											Type:  CriteriaTypePath,
+											Value: "/account",
+										},
+									},
+								},
+							},
+						},
+					},
+
+					RespondWith: RespondWith{
+						Status: 418,
+						Body:   "Proxy Response",
+					},
+				},
+			},
+			scenarios: []scenario{
+				{
+					request{
+						method: "GET",
+						url:    "http://www.geckoboard.com/dashboards",
+					},
+					response{
+						status: 418,
+						body:   "Proxy Response",
+					},
+				},
+				{
+					request{
+						method: "DELETE",
+						url:    "http://app.geckoboard.com/dashboards",
+					},
+					response{
+						status: 418,
+						body:   "Proxy Response",
+					},
+				},
+				{
+					request{
+						method: "GET",
+						url:    "http://blog.geckoboard.com/dashboards",
+					},
+					blockedResponse,
+				},
+				{
+					request{
+						method: "GET",
+						url:    "http://app.geckoboard.com/admin/users",
+					},
+					blockedResponse,
+				},
+				{
+					request{
+						method: "DELETE",
+						url:    "http://app.geckoboard.com/account",
+					},
+					blockedResponse,
+				},
+			},
+		},
+
+		// Responding With Custom Headers
+		{
+			expectations: []Expectation{
+				{
+					RequestCriteria: Criteria{
+						{
+							Type:  CriteriaTypeMethod,
+							Value: "GET",
+						},
+					},
+
+					RespondWith: RespondWith{
+						Status: 418,
+						Body:   "Proxy Response",
+						Headers: map[string]string{
+							"X-Custom-Header": "Yup it got set",
+						},
+					},
+				},
+			},
+			scenarios: []scenario{
+				{
+					request{
+						method: "GET",
+						url:    websiteServer.URL,
+					},
+					response{
+						status: 418,
+						body:   "Proxy Response",
+						headers: map[string]string{
+							"X-Custom-Header": "Yup it got set",
+						},
+					},
+				},
+			},
+		},
+
+		// Responding With A Templated Response
+		{
+			expectations: []Expectation{
+				{
+					RequestCriteria: Criteria{
+						{
+							Type:      CriteriaTypePath,
+							Value:     "^/users/",
+							MatchType: MatchTypeRegex,
+						},
+					},
+
+					RespondWith: RespondWith{
+						Status:    201,
+						Templated: true,
+						Body:      `{"id": "{{ .PathSegment 1 }}", "name": "{{ .JSONPath "$.name" }}", "page": "{{ .Query.Get "page" }}", "agent": "{{ .Headers.Get "User-Agent" }}"}`,
+						Headers: map[string]string{
+							"Location": "/users/{{ .PathSegment 1 }}",
+						},
+					},
+				},
+			},
+			scenarios: []scenario{
+				{
+					request{
+						method:  "PUT",
+						url:     "http://www.geckoboard.com/users/42?page=3",
+						body:    `{"name": "Katniss"}`,
+						headers: map[string]string{"User-Agent": "Everdeen Test"},
+					},
+					response{
+						status: 201,
+						body:   `{"id": "42", "name": "Katniss", "page": "3", "agent": "Everdeen Test"}`,
+						headers: map[string]string{
+							"Location": "/users/42",
+						},
+					},
+				},
+			},
+		},
+
+		// Responding With Binary Body (Base64 Encoded)
+		{
+			expectations: []Expectation{
+				{
+					RequestCriteria: Criteria{
+						{
+							Type:  CriteriaTypeMethod,
+							Value: "GET",
+						},
+					},
+
+					RespondWith: RespondWith{
+						Status:       418,
+						Body:         "SGVsbG8gV29ybGQ=",
+						BodyEncoding: BodyEncodingBase64,
+					},
+				},
+			},
+			scenarios: []scenario{
+				{
+					request{
+						method: "GET",
+						url:    websiteServer.URL,
+					},
+					response{
+						status: 418,
+						body:   "Hello World",
+					},
+				},
+			},
+		},
+
+		// Max Matches
+		{
+			expectations: []Expectation{
+				{
+					RequestCriteria: Criteria{
+						{
+							Type:  CriteriaTypeMethod,
+							Value: "GET",
+						},
+					},
+
+					RespondWith: RespondWith{
+						Status: 418,
+						Body:   "Proxy Response",
+					},
+
+					MaxMatches: 2,
+				},
+			},
+			scenarios: []scenario{
+				{
+					request{
+						method: "GET",
+						url:    websiteServer.URL,
+					},
+					response{
+						status: 418,
+						body:   "Proxy Response",
+					},
+				},
+				{
+					request{
+						method: "GET",
+						url:    websiteServer.URL,
+					},
+					response{
+						status: 418,
+						body:   "Proxy Response",
+					},
+				},
+				{
+					request{
+						method: "GET",
+						url:    websiteServer.URL,
+					},
+					blockedResponse,
+				},
+			},
+		},
+
+		// Response Sequence (Repeat Last)
+		{
+			expectations: []Expectation{
+				{
+					RequestCriteria: Criteria{
+						{
+							Type:  CriteriaTypeMethod,
+							Value: "GET",
+						},
+					},
+
+					RespondWithSequence: []RespondWith{
+						{Status: 503, Body: "Unavailable"},
+						{Status: 503, Body: "Unavailable"},
+						{Status: 200, Body: "OK"},
+					},
+				},
+			},
+			scenarios: []scenario{
+				{
+					request{
+						method: "GET",
+						url:    websiteServer.URL,
+					},
+					response{
+						status: 503,
+						body:   "Unavailable",
+					},
+				},
+				{
+					request{
+						method: "GET",
+						url:    websiteServer.URL,
+					},
+					response{
+						status: 503,
+						body:   "Unavailable",
+					},
+				},
+				{
+					request{
+						method: "GET",
+						url:    websiteServer.URL,
+					},
+					response{
+						status: 200,
+						body:   "OK",
+					},
+				},
+				{
+					request{
+						method: "GET",
+						url:    websiteServer.URL,
+					},
+					response{
+						status: 200,
+						body:   "OK",
+					},
+				},
+			},
+		},
+
+		// Response Sequence (Cycle)
+		{
+			expectations: []Expectation{
+				{
+					RequestCriteria: Criteria{
+						{
+							Type:  CriteriaTypeMethod,
+							Value: "GET",
+						},
+					},
+
+					RespondWithSequence: []RespondWith{
+						{Status: 503, Body: "Unavailable"},
+						{Status: 200, Body: "OK"},
+					},
+					SequenceExhausted: SequenceExhaustedCycle,
+				},
+			},
+			scenarios: []scenario{
+				{
+					request{
+						method: "GET",
+						url:    websiteServer.URL,
+					},
+					response{
+						status: 503,
+						body:   "Unavailable",
+					},
+				},
+				{
+					request{
+						method: "GET",
+						url:    websiteServer.URL,
+					},
+					response{
+						status: 200,
+						body:   "OK",
+					},
+				},
+				{
+					request{
+						method: "GET",
+						url:    websiteServer.URL,
+					},
+					response{
+						status: 503,
+						body:   "Unavailable",
+					},
+				},
+				{
+					request{
+						method: "GET",
+						url:    websiteServer.URL,
+					},
+					response{
+						status: 200,
+						body:   "OK",
+					},
+				},
+			},
+		},
+
+		// Response Sequence (Fall Through)
+		{
+			expectations: []Expectation{
+				{
+					RequestCriteria: Criteria{
+						{
+							Type:  CriteriaTypeMethod,
+							Value: "GET",
+						},
+					},
+
+					RespondWithSequence: []RespondWith{
+						{Status: 503, Body: "Unavailable"},
+						{Status: 200, Body: "OK"},
+					},
+					SequenceExhausted: SequenceExhaustedFallThrough,
+				},
+				{
+					RequestCriteria: Criteria{
+						{
+							Type:  CriteriaTypeMethod,
+							Value: "GET",
+						},
+					},
+
+					RespondWith: RespondWith{
+						Status: 418,
+						Body:   "Proxy Response",
+					},
+				},
+			},
+			scenarios: []scenario{
+				{
+					request{
+						method: "GET",
+						url:    websiteServer.URL,
+					},
+					response{
+						status: 503,
+						body:   "Unavailable",
+					},
+				},
+				{
+					request{
+						method: "GET",
+						url:    websiteServer.URL,
+					},
+					response{
+						status: 200,
+						body:   "OK",
+					},
+				},
+				{
+					request{
+						method: "GET",
+						url:    websiteServer.URL,
+					},
+					response{
+						status: 418,
+						body:   "Proxy Response",
+					},
+				},
+			},
+		},
+
+		// Priority
+		{
+			expectations: []Expectation{
+				{
+					RequestCriteria: Criteria{
+						{
+							Type:      CriteriaTypeHost,
+							MatchType: MatchTypeRegex,
+							Value:     ".*",
+						},
+					},
+
+					RespondWith: RespondWith{
+						Status: 418,
+						Body:   "Catch All",
+					},
+				},
+				{
+					Priority: 10,
+					RequestCriteria: Criteria{
+						{
+							Type:  CriteriaTypePath,
+							Value: "/specific",
+						},
+					},
+
+					RespondWith: RespondWith{
+						Status: 200,
+						Body:   "Specific",
+					},
+				},
+				{
+					Priority: 10,
+					RequestCriteria: Criteria{
+						{
+							Type:      CriteriaTypePath,
+							MatchType: MatchTypeRegex,
+							Value:     "/specific.*",
+						},
+					},
+
+					RespondWith: RespondWith{
+						Status: 200,
+						Body:   "Newer",
+					},
+				},
+			},
+			scenarios: []scenario{
+				{
+					request{
+						method: "GET",
+						url:    websiteServer.URL + "/specific",
+					},
+					response{
+						status: 200,
+						body:   "Specific",
+					},
+				},
+				{
+					request{
+						method: "GET",
+						url:    websiteServer.URL + "/specific-too",
+					},
+					response{
+						status: 200,
+						body:   "Newer",
+					},
+				},
+				{
+					request{
+						method: "GET",
+						url:    websiteServer.URL + "/other",
+					},
+					response{
+						status: 418,
+						body:   "Catch All",
+					},
+				},
+			},
+		},
+
+		// Pass Through
+		{
+			expectations: []Expectation{
+				{
+					RequestCriteria: Criteria{
+						{
+							Type:  CriteriaTypeMethod,
+							Value: "GET",
+						},
+					},
+
+					PassThrough: true,
+				},
+			},
+
+			scenarios: []scenario{
+				{
+					request{
+						method: "GET",
+						url:    websiteServer.URL,
+					},
+					response{
+						status: 200,
+						body:   "Got Through",
+					},
+				},
+
+				{
+					request{
+						method: "POST",
+						url:    websiteServer.URL,
+					},
+					blockedResponse,
+				},
+			},
+		},
+	}
+
+	for i, tc := range testCases {
+		runTestCase(t, i, tc)
+	}
+}
+
+func runTestCase(t *testing.T, i int, tc testCase) {
+	proxy, proxyServer, proxyClient := buildProxy()
+	defer proxyServer.Close()
+
+	server := &Server{Proxy: proxy}
+	proxy.OnRequest().DoFunc(server.handleProxyRequest)
+
+	cer := CreateExpectationsRequest{tc.expectations}
+	createExpectations(t, server, &cer)
+
+	for idx, scenario := range tc.scenarios {
+		req, err := http.NewRequest(scenario.request.method, scenario.request.url, strings.NewReader(scenario.request.body))
+		if err != nil {
+			t.Fatalf("[%d - %d] error building request for scenario: %v", i, idx, err)
+		}
+
+		for key, value := range scenario.request.headers {
+			req.Header.Add(key, value)
+		}
+
+		resp, err := proxyClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.StatusCode != scenario.response.status {
+			t.Errorf("[%d - %d] unexpected response status, expected: %d, got: %d", i, idx, scenario.response.status, resp.StatusCode)
+		}
+
+		bodyBytes, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("[%d - %d] error reading body: %v", i, idx, err)
+		}
+
+		body := string(bodyBytes)
+		if body != scenario.response.body {
+			t.Errorf("[%d - %d] unexpected response body, expected: %s, got: %s", i, idx, scenario.response.body, body)
+		}
+
+		for key, value := range scenario.response.headers {
+			got := resp.Header.Get(key)
+
+			if value != got {
+				t.Errorf("[%d - %d] unexpected value for header: %s, expected: %s, got: %s", i, idx, key, value, got)
+			}
+		}
+	}
+}
+
+func TestRequestMatchingExpectationUuid(t *testing.T) {
+	proxy, proxyServer, proxyClient := buildProxy()
+	defer proxyServer.Close()
+
+	server := &Server{Proxy: proxy}
+	proxy.OnRequest().DoFunc(server.handleProxyRequest)
+
+	//Setup an expectation
+	expectations := []Expectation{
+		{
+			StoreMatchingRequests: true,
+			RequestCriteria: Criteria{
+				{
+					Type:  CriteriaTypeMethod,
+					Value: "POST",
+				},
+				{
+					Type:  CriteriaTypeHost,
+					Value: "www.geckoboard.com",
+				},
+				{
+					Type:  CriteriaTypePath,
+					Value: "/hello-world",
+				},
+			},
+			RespondWith: RespondWith{
+				Status:       http.StatusOK,
+				Body:         "Its me!!!",
+				BodyEncoding: BodyEncodingNone,
+			},
+		},
+	}
+
+	cer := CreateExpectationsRequest{expectations}
+	exp := createExpectations(t, server, &cer)
+
+	if uuid.Equal(exp[0].Uuid, uuid.Nil) {
+		t.Fatalf("Expected returned expectation to have uuid but it didn't: %#v", exp[0])
+	}
+
+	req, err := http.NewRequest("POST", "http://www.geckoboard.com/hello-world", strings.NewReader("Some Stuff"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Add("X-Some-Header", "Hello World")
+	req.Header.Add("User-Agent", "Awesome User Agent")
+
+	_, err = proxyClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err = http.NewRequest("GET", "/expectations/"+exp[0].Uuid.String()+"/requests", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Errorf("unexpected status code %d when finding requests with uuid %s", rec.Code, exp[0].Uuid)
+	}
+
+	findResponse := FindResponse{}
+	if err := json.NewDecoder(rec.Body).Decode(&findResponse); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, found := range findResponse.Requests {
+		if found.Time.IsZero() || found.ClientAddr == "" || found.DurationMs <= 0 {
+			t.Errorf("expected the stored request to have a time, client address and duration, got: %#v", found)
+		}
+
+		findResponse.Requests[i].Time = time.Time{}
+		findResponse.Requests[i].ClientAddr = ""
+		findResponse.Requests[i].DurationMs = 0
+	}
+
+	if !reflect.DeepEqual(findResponse, FindResponse{
+		Requests: []Request{
+			{
+				Id:     1,
+				URL:    "http://www.geckoboard.com/hello-world",
+				Method: "POST",
+				Headers: map[string][]string{
+					"Accept-Encoding": []string{"gzip"},
+					"Content-Length":  []string{"10"},
+					"X-Some-Header":   []string{"Hello World"},
+					"User-Agent":      []string{"Awesome User Agent"},
+				},
+				BodyBase64:      "U29tZSBTdHVmZg==",
+				ExpectationUuid: exp[0].Uuid,
+				Response: &Response{
+					Status:     http.StatusOK,
+					Headers:    map[string][]string{},
+					BodyBase64: "SXRzIG1lISEh",
+				},
+			},
+		},
+	}) {
+		t.Errorf("unexpected response from /expectations/%s/requests endpoint: %#v", expectations[0].Uuid, findResponse)
+	}
+}
+
+func TestStoringPassThroughRequests(t *testing.T) {
+	websiteServer := buildWebsiteServer()
+	defer websiteServer.Close()
+
+	proxy, proxyServer, proxyClient := buildProxy()
+	defer proxyServer.Close()
+
+	server := &Server{Proxy: proxy, requestStore: NewMemoryRequestStore(0)}
+	proxy.OnRequest().DoFunc(server.handleProxyRequest)
+	proxy.OnResponse().DoFunc(server.handleProxyResponse)
+
+	cer := CreateExpectationsRequest{[]Expectation{
+		{
+			PassThrough:           true,
+			StoreMatchingRequests: true,
+			RequestCriteria:       Criteria{{Type: CriteriaTypePath, Value: "/through"}},
+		},
+	}}
+	created := createExpectations(t, server, &cer)
+
+	resp, err := proxyClient.Get(websiteServer.URL + "/through")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if string(body) != "Got Through" {
+		t.Fatalf("expected the request to pass through, got: %s", body)
+	}
+
+	found, err := server.store().Where(created[0].Uuid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(found) != 1 {
+		t.Fatalf("expected 1 stored request, got: %d", len(found))
+	}
+
+	stored := found[0]
+	if stored.Response == nil || stored.Response.Status != http.StatusOK || stored.Response.BodyBase64 != base64.StdEncoding.EncodeToString(body) {
+		t.Errorf("expected the upstream response to be stored, got: %#v", stored.Response)
+	}
+
+	if stored.UpstreamLatencyMs <= 0 || !uuid.Equal(stored.ExpectationUuid, created[0].Uuid) {
+		t.Errorf("expected the upstream latency and expectation to be stored, got: %#v", stored)
+	}
+}
+
+func TestStreamingPassThroughResponses(t *testing.T) {
+	release := make(chan struct{})
+
+	// More than the proxy's response writer buffers, so it has to send the
+	// start of the response on before the rest arrives
+	start := strings.Repeat("x", 64<<10)
+
+	websiteServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, start)
+		w.(http.Flusher).Flush()
+
+		<-release
+		fmt.Fprint(w, "Through")
+	}))
+	defer websiteServer.Close()
+
+	proxy, proxyServer, proxyClient := buildProxy()
+	defer proxyServer.Close()
+
+	server := &Server{Proxy: proxy}
+	proxy.OnRequest().DoFunc(server.handleProxyRequest)
+	proxy.OnResponse().DoFunc(server.handleProxyResponse)
+
+	cer := CreateExpectationsRequest{[]Expectation{{PassThrough: true}}}
+	createExpectations(t, server, &cer)
+
+	responses := make(chan *http.Response, 1)
+	go func() {
+		resp, err := proxyClient.Get(websiteServer.URL + "/slow")
+		if err != nil {
+			t.Error(err)
+			close(responses)
+			return
+		}
+
+		responses <- resp
+	}()
+
+	var resp *http.Response
+
+	select {
+	case resp = <-responses:
+	case <-time.After(2 * time.Second):
+		close(release)
+		t.Fatal("expected the response headers before the upstream server finished the body")
+	}
+
+	if resp == nil {
+		close(release)
+		return
+	}
+
+	close(release)
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if string(body) != start+"Through" {
+		t.Fatalf("expected the whole body to be streamed through, got %d bytes", len(body))
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		entries := server.journal.Entries()
+		if len(entries) == 1 && entries[0].Response != nil {
+			if entries[0].Response.BodyBase64 != base64.StdEncoding.EncodeToString(body) || entries[0].DurationMs <= 0 {
+				t.Errorf("expected the streamed response to be journaled, got: %+v", entries[0])
+			}
+
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the streamed response to be journaled, got: %+v", entries)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestStoringUnreachablePassThroughRequests(t *testing.T) {
+	useTestCA(t)
+
+	// Nothing listens on the address once the listener is closed
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+
+	server := &Server{Proxy: proxy, requestStore: NewMemoryRequestStore(0)}
+	proxy.OnRequest().DoFunc(server.handleProxyRequest)
+	proxy.OnResponse().DoFunc(server.handleProxyResponse)
+
+	proxyServer := httptest.NewServer(server.ProxyHandler())
+	defer proxyServer.Close()
+
+	transport := &http.Transport{
+		Proxy: func(r *http.Request) (*url.URL, error) {
+			return url.Parse(proxyServer.URL)
+		},
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}
+	defer transport.CloseIdleConnections()
+
+	cer := CreateExpectationsRequest{[]Expectation{{PassThrough: true, StoreMatchingRequests: true}}}
+	created := createExpectations(t, server, &cer)
+
+	events := server.events.subscribe(eventFilter{})
+	defer server.events.unsubscribe(events)
+
+	if resp, err := (&http.Client{Transport: transport}).Get("https://" + addr + "/down"); err == nil {
+		resp.Body.Close()
+		t.Fatalf("expected the request to an unreachable server to fail, got: %d", resp.StatusCode)
+	}
+
+	select {
+	case event := <-events:
+		if !event.PassThrough || event.Status != 0 {
+			t.Errorf("unexpected event for the unreachable request: %+v", event)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("expected an event for the unreachable request")
+	}
+
+	found, err := server.store().Where(created[0].Uuid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(found) != 1 || found[0].Response != nil || found[0].URL != "https://"+addr+"/down" {
+		t.Errorf("expected the request to be stored without a response, got: %+v", found)
+	}
+
+	if entries := server.journal.Entries(); len(entries) != 1 || entries[0].Response != nil || entries[0].DurationMs <= 0 {
+		t.Errorf("expected the request to be journaled without a response, got: %+v", entries)
+	}
+}
+
+func TestFilteringStoredRequests(t *testing.T) {
+	proxy, proxyServer, proxyClient := buildProxy()
+	defer proxyServer.Close()
+
+	server := &Server{Proxy: proxy, requestStore: NewMemoryRequestStore(0)}
+	proxy.OnRequest().DoFunc(server.handleProxyRequest)
+
+	cer := CreateExpectationsRequest{[]Expectation{
+		{
+			StoreMatchingRequests: true,
+			RequestCriteria:       Criteria{{Type: CriteriaTypeHost, Value: "www.geckoboard.com"}},
+			RespondWith:           RespondWith{Status: http.StatusOK},
+		},
+	}}
+	exp := createExpectations(t, server, &cer)
+
+	for _, path := range []string{"/a", "/b", "/c"} {
+		req, err := http.NewRequest("POST", "http://www.geckoboard.com"+path, strings.NewReader(path))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := proxyClient.Do(req); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	find := func(query string) (int, []Request) {
+		req, err := http.NewRequest("GET", "/expectations/"+exp[0].Uuid.String()+"/requests?"+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+
+		findResponse := FindResponse{}
+		json.NewDecoder(rec.Body).Decode(&findResponse)
+
+		return rec.Code, findResponse.Requests
+	}
+
+	if code, found := find("sort=desc&limit=1"); code != http.StatusOK || len(found) != 1 || found[0].URL != "http://www.geckoboard.com/c" {
+		t.Errorf("expected the latest request, got %d: %+v", code, found)
+	}
+
+	if code, found := find("since_id=1&path=/b"); code != http.StatusOK || len(found) != 1 || found[0].Id != 2 {
+		t.Errorf("expected the second request, got %d: %+v", code, found)
+	}
+
+	if code, _ := find("limit=lots"); code != http.StatusBadRequest {
+		t.Errorf("expected a bad request for an invalid limit, got %d", code)
+	}
+}
+
+func TestRequestsReturnsNotFoundWhenUuidNotExists(t *testing.T) {
+	proxy, proxyServer, _ := buildProxy()
+	defer proxyServer.Close()
+
+	server := &Server{Proxy: proxy}
+	proxy.OnRequest().DoFunc(server.handleProxyRequest)
+
+	req, err := http.NewRequest("GET", "/expectations/1293/requests", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("unexpected status code %d with request id that doesn't exist", rec.Code)
+	}
+}
+
+func TestRequestReturnsEmptyArrayWithNoMatchingRequests(t *testing.T) {
+	proxy, proxyServer, proxyClient := buildProxy()
+	defer proxyServer.Close()
+
+	server := &Server{Proxy: proxy}
+	proxy.OnRequest().DoFunc(server.handleProxyRequest)
+
+	//Setup an expectation that isn't going to match
+	expectations := []Expectation{
+		{
+			StoreMatchingRequests: true,
+			RequestCriteria: Criteria{
+				{
+					Type:  CriteriaTypeHost,
+					Value: "www.google.com",
+				},
+			},
+			RespondWith: RespondWith{
+				Status:       http.StatusOK,
+				Body:         "Its me!!!",
+				BodyEncoding: BodyEncodingNone,
+			},
+		},
+	}
+
+	cer := CreateExpectationsRequest{expectations}
+	exp := createExpectations(t, server, &cer)
+
+	if uuid.Equal(exp[0].Uuid, uuid.Nil) {
+		t.Fatalf("Expected exp returned to have uuid but it did not %s", exp[0].Uuid)
+	}
+
+	req, err := http.NewRequest("GET", "http://www.geckoboard.com/hello-world", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = proxyClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err = http.NewRequest("GET", "/expectations/"+exp[0].Uuid.String()+"/requests", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Errorf("unexpected status code %d with expectation uuid %s", rec.Code, exp[0].Uuid)
+	}
+
+	if strings.TrimRight(rec.Body.String(), `\n\t`) == `{"requests":[]}` {
+		t.Errorf("unexpected response from /expectations/%s/requests endpoint: '%s'", exp[0].Uuid, rec.Body.String())
+	}
+}
+
+func buildProxy() (*goproxy.ProxyHttpServer, *httptest.Server, *http.Client) {
+	proxy := goproxy.NewProxyHttpServer()
+	proxyServer := httptest.NewServer(proxy)
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy: func(r *http.Request) (*url.URL, error) {
+				return url.Parse(proxyServer.URL)
+			},
+		},
+	}
+
+	return proxy, proxyServer, client
+}
+
+var testCAOnce sync.Once
+
+// useTestCA has MITM'd HTTPS requests signed by a CA of the test's own, as
+// the -ca-cert and -ca-key flags do.
+func useTestCA(t *testing.T) {
+	testCAOnce.Do(func() {
+		cert, priv, err := certs.NewCertificatePair("everdeen test CA", "everdeen", time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		goproxy.GoproxyCa = tls.Certificate{Certificate: [][]byte{cert.Raw}, PrivateKey: priv, Leaf: cert}
+	})
+}
+
+func multipartBody(fileName, contentType string) string {
+	return strings.Join([]string{
+		"--everdeen",
+		`Content-Disposition: form-data; name="tags"`,
+		"",
+		"a",
+		"--everdeen",
+		`Content-Disposition: form-data; name="tags"`,
+		"",
+		"b",
+		"--everdeen",
+		`Content-Disposition: form-data; name="avatar"; filename="` + fileName + `"`,
+		"Content-Type: " + contentType,
+		"",
+		"not really an image",
+		"--everdeen--",
+		"",
+	}, "\r\n")
+}
+
+func buildWebsiteServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "Got Through")
+	}))
+}
+
+// serveControl sends a request to the control API.
+func serveControl(t *testing.T, server *Server, method, path, body string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest(method, path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, req)
+	return rec
+}
+
+// proxyGet sends a GET through the proxy, returning the status and body.
+func proxyGet(t *testing.T, client *http.Client, url string, headers map[string]string) (int, string) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+func createExpectations(t *testing.T, server *Server, cer *CreateExpectationsRequest) []*Expectation {
+	data, err := json.Marshal(cer)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("POST", "/expectations", bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Unexpected status code [ %d ] while setting up expectations", rec.Code)
+	}
+
+	var expectations []*Expectation
+	err = json.Unmarshal(rec.Body.Bytes(), &expectations)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return expectations
+}
+
+func TestResetAllEndpointRequest(t *testing.T) {
+	proxy, proxyServer, _ := buildProxy()
+	defer proxyServer.Close()
+
+	server := &Server{Proxy: proxy}
+	proxy.OnRequest().DoFunc(server.handleProxyRequest)
+
+	expectations := []Expectation{
+		{
+			RequestCriteria: Criteria{
+				{
+					Type:  CriteriaTypeHost,
+					Value: "www.google.com",
+				},
+			},
+		},
+	}
+
+	cer := CreateExpectationsRequest{expectations}
+	createExpectations(t, server, &cer)
+
+	// Check that one expectation exists
+	exps := listsExpectationsResponse(t, server)
+	if len(exps) != 1 {
+		t.Errorf("Expected one expectation to be returned but got %d", len(exps))
+	}
+
+	// Now post to the reset_all endpoint
+	req, err := http.NewRequest("DELETE", "/reset/all", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, req)
+
+	if rec.Code != 200 {
+		t.Errorf("Expected 200 response code to /reset_all but got %d", rec.Code)
+	}
+
+	// Now query the expectations endpoint and verify none exist
+	exps = listsExpectationsResponse(t, server)
+	if len(exps) != 0 {
+		t.Errorf("Expected no expectations to be returned but got %d", len(exps))
+	}
+}
+
+func TestSingleExpectationEndpoints(t *testing.T) {
+	proxy, proxyServer, proxyClient := buildProxy()
+	defer proxyServer.Close()
+
+	server := &Server{Proxy: proxy}
+	proxy.OnRequest().DoFunc(server.handleProxyRequest)
+
+	cer := CreateExpectationsRequest{[]Expectation{
+		{
+			RequestCriteria:       Criteria{{Type: CriteriaTypePath, Value: "/one"}},
+			RespondWith:           RespondWith{Status: 200, Body: "one"},
+			StoreMatchingRequests: true,
+		},
+		{
+			RequestCriteria: Criteria{{Type: CriteriaTypePath, Value: "/two"}},
+			RespondWith:     RespondWith{Status: 200, Body: "two"},
+		},
+	}}
+	created := createExpectations(t, server, &cer)
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+		return rec
+	}
+
+	proxyGet := func(path string) (int, string) {
+		resp, err := proxyClient.Get("http://example.com" + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	one := "/expectations/" + created[0].Uuid.String()
+	two := "/expectations/" + created[1].Uuid.String()
+
+	proxyGet("/one")
+
+	rec := do("GET", one, "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected GET to respond 200, got: %d", rec.Code)
+	}
+
+	var exp Expectation
+	json.Unmarshal(rec.Body.Bytes(), &exp)
+	if !uuid.Equal(exp.Uuid, created[0].Uuid) || exp.Matches != 1 {
+		t.Errorf("unexpected expectation returned: %+v", &exp)
+	}
+
+	if rec := do("GET", "/expectations/"+uuid.NewV4().String(), ""); rec.Code != http.StatusNotFound {
+		t.Errorf("expected GET of an unknown expectation to respond 404, got: %d", rec.Code)
+	}
+
+	// PATCH only replaces the given fields
+	rec = do("PATCH", one, `{"respond_with": {"status": 201, "body": "patched"}}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected PATCH to respond 200, got: %d %s", rec.Code, rec.Body)
+	}
+
+	if status, body := proxyGet("/one"); status != 201 || body != "patched" {
+		t.Errorf("expected the patched response, got: %d %s", status, body)
+	}
+
+	// PUT replaces the whole expectation, keeping its UUID and matches
+	rec = do("PUT", one, `{"request_criteria": [{"type": "path", "value": "/uno"}], "respond_with": {"status": 200, "body": "put"}}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected PUT to respond 200, got: %d %s", rec.Code, rec.Body)
+	}
+
+	json.Unmarshal(rec.Body.Bytes(), &exp)
+	if !uuid.Equal(exp.Uuid, created[0].Uuid) || exp.Matches != 2 || exp.StoreMatchingRequests {
+		t.Errorf("unexpected expectation after PUT: %+v", &exp)
+	}
+
+	if status, _ := proxyGet("/one"); status != http.StatusNotFound {
+		t.Errorf("expected the old criteria to no longer match, got: %d", status)
+	}
+
+	if _, body := proxyGet("/uno"); body != "put" {
+		t.Errorf("expected the new expectation to respond, got: %s", body)
+	}
+
+	if rec := do("PUT", one, `{"request_criteria": [{"type": "path", "match_type": "regex", "value": "("}]}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected an invalid PUT to respond 400, got: %d", rec.Code)
+	}
+
+	// DELETE removes the expectation, and its requests if asked to
+	if rec := do("DELETE", two, ""); rec.Code != http.StatusOK {
+		t.Errorf("expected DELETE to respond 200, got: %d", rec.Code)
+	}
+
+	if status, _ := proxyGet("/two"); status != http.StatusNotFound {
+		t.Errorf("expected the deleted expectation to no longer match, got: %d", status)
+	}
+
+	if found, _ := server.store().Where(created[0].Uuid); len(found) != 2 {
+		t.Fatalf("expected 2 stored requests, got: %d", len(found))
+	}
+
+	do("DELETE", one+"?delete_requests=true", "")
+
+	if found, _ := server.store().Where(created[0].Uuid); len(found) != 0 {
+		t.Errorf("expected the stored requests to be deleted, got: %d", len(found))
+	}
+
+	if exps := listsExpectationsResponse(t, server); len(exps) != 0 {
+		t.Errorf("expected no expectations to remain, got: %d", len(exps))
+	}
+}
+
+func TestMatchOrderNewestFirst(t *testing.T) {
+	older := &Expectation{RequestCriteria: Criteria{{Type: CriteriaTypeMethod, MatchType: MatchTypeExact, Value: "GET"}}}
+	newer := &Expectation{RequestCriteria: Criteria{{Type: CriteriaTypeMethod, MatchType: MatchTypeExact, Value: "GET"}}}
+	lower := &Expectation{Priority: -1, RequestCriteria: Criteria{{Type: CriteriaTypeMethod, MatchType: MatchTypeExact, Value: "GET"}}}
+
+	req, err := http.NewRequest("GET", "http://example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		newestFirst bool
+		expected    *Expectation
+	}{
+		{false, older},
+		{true, newer},
+	}
+
+	for _, tc := range testCases {
+		server := &Server{
+			expectations: []*Expectation{older, newer, lower},
+			newestFirst:  tc.newestFirst,
+		}
+
+		found, err := server.findMatchingExpectation(req, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if found != tc.expected {
+			t.Errorf("newestFirst %t: expected %p, got %p", tc.newestFirst, tc.expected, found)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	proxy, proxyServer, proxyClient := buildProxy()
+	defer proxyServer.Close()
+
+	server := &Server{Proxy: proxy}
+	proxy.OnRequest().DoFunc(server.handleProxyRequest)
+
+	cer := CreateExpectationsRequest{[]Expectation{
+		{
+			RequestCriteria: Criteria{{Type: CriteriaTypePath, Value: "/customers"}},
+			RespondWith:     RespondWith{Status: 201},
+		},
+	}}
+	created := createExpectations(t, server, &cer)
+
+	for _, path := range []string{"/customers", "/customers", "/unstubbed"} {
+		resp, err := proxyClient.Post("http://example.com"+path, "application/json", strings.NewReader(`{"name": "Jane"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	verify := func(body string) (int, VerifyResponse) {
+		req, err := http.NewRequest("POST", "/verify", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+
+		var resp VerifyResponse
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		return rec.Code, resp
+	}
+
+	expUuid := created[0].Uuid.String()
+
+	testCases := []struct {
+		verification string
+		passed       bool
+		count        int
+		message      string
+	}{
+		{`{"expectation_uuid": "` + expUuid + `"}`, true, 2, ""},
+		{`{"expectation_uuid": "` + expUuid + `", "exactly": 2}`, true, 2, ""},
+		{`{"expectation_uuid": "` + expUuid + `", "at_most": 1}`, false, 2, "expected at most 1 matching requests, got 2"},
+		{`{"expectation_uuid": "` + expUuid + `", "at_least": 3}`, false, 2, "expected at least 3 matching requests, got 2"},
+		{`{"expectation_uuid": "` + uuid.NewV4().String() + `"}`, false, 0, "not found"},
+		{`{"request_criteria": [{"type": "path", "value": "/unstubbed"}], "exactly": 1}`, true, 1, ""},
+		{`{"request_criteria": [{"type": "body", "match_type": "json_contains", "value": "{\"name\": \"Jane\"}"}]}`, true, 3, ""},
+		{`{"request_criteria": [{"type": "path", "value": "/invoices"}], "at_least": 1}`, false, 0, "expected at least 1 matching requests, got 0"},
+		{`{"request_criteria": [{"type": "path", "value": "/invoices"}], "exactly": 0}`, true, 0, ""},
+	}
+
+	for i, tc := range testCases {
+		code, resp := verify(`{"verifications": [` + tc.verification + `]}`)
+		if code != http.StatusOK || len(resp.Results) != 1 {
+			t.Errorf("[%d] unexpected response: %d %+v", i, code, resp)
+			continue
+		}
+
+		result := resp.Results[0]
+		if resp.Passed != tc.passed || result.Passed != tc.passed || result.Count != tc.count || !strings.Contains(result.Message, tc.message) {
+			t.Errorf("[%d] unexpected result: %+v", i, result)
+		}
+	}
+
+	code, resp := verify(`{"verifications": [
+		{"expectation_uuid": "` + expUuid + `"},
+		{"request_criteria": [{"type": "path", "value": "/invoices"}]}
+	]}`)
+	if code != http.StatusOK || resp.Passed || !resp.Results[0].Passed || resp.Results[1].Passed {
+		t.Errorf("expected the report to fail when any verification fails, got: %+v", resp)
+	}
+
+	invalid := []string{
+		`{"verifications": [{}]}`,
+		`{"verifications": [{"expectation_uuid": "` + expUuid + `", "request_criteria": [{"type": "path", "value": "/"}]}]}`,
+		`{"verifications": [{"expectation_uuid": "` + expUuid + `", "exactly": 1, "at_least": 1}]}`,
+		`{"verifications": [{"expectation_uuid": "` + expUuid + `", "at_least": -1}]}`,
+		`{"verifications": [{"request_criteria": [{"type": "path", "match_type": "regex", "value": "("}]}]}`,
+	}
+
+	for _, body := range invalid {
+		if code, _ := verify(body); code != http.StatusBadRequest {
+			t.Errorf("expected %s to respond 400, got: %d", body, code)
+		}
+	}
+}
+
+func TestWait(t *testing.T) {
+	proxy, proxyServer, proxyClient := buildProxy()
+	defer proxyServer.Close()
+
+	server := &Server{Proxy: proxy}
+	proxy.OnRequest().DoFunc(server.handleProxyRequest)
+
+	cer := CreateExpectationsRequest{[]Expectation{
+		{
+			RequestCriteria: Criteria{{Type: CriteriaTypePath, Value: "/customers"}},
+			RespondWith:     RespondWith{Status: 201},
+		},
+	}}
+	created := createExpectations(t, server, &cer)
+
+	wait := func(body string) (int, WaitResponse) {
+		req, err := http.NewRequest("POST", "/wait", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+
+		var resp WaitResponse
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		return rec.Code, resp
+	}
+
+	type result struct {
+		code int
+		resp WaitResponse
+	}
+
+	expUuid := created[0].Uuid.String()
+	matched := make(chan result)
+	unstubbed := make(chan result)
+
+	go func() {
+		code, resp := wait(`{"expectation_uuid": "` + expUuid + `", "at_least": 2, "timeout_ms": 5000}`)
+		matched <- result{code, resp}
+	}()
+
+	go func() {
+		code, resp := wait(`{"request_criteria": [{"type": "path", "value": "/unstubbed"}], "timeout_ms": 5000}`)
+		unstubbed <- result{code, resp}
+	}()
+
+	// Give the waits a chance to start
+	time.Sleep(50 * time.Millisecond)
+
+	for _, path := range []string{"/customers", "/unstubbed", "/customers"} {
+		resp, err := proxyClient.Post("http://example.com"+path, "text/plain", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	for name, ch := range map[string]chan result{"matches": matched, "criteria": unstubbed} {
+		select {
+		case r := <-ch:
+			if r.code != http.StatusOK || !r.resp.Passed {
+				t.Errorf("expected waiting for %s to pass, got %d: %+v", name, r.code, r.resp)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("expected waiting for %s to finish once requests arrived", name)
+		}
+	}
+
+	start := time.Now()
+	code, resp := wait(`{"expectation_uuid": "` + expUuid + `", "at_least": 3, "timeout_ms": 50}`)
+	if code != http.StatusOK || resp.Passed || resp.Count != 2 || !strings.Contains(resp.Message, "timed out") {
+		t.Errorf("expected the wait to time out, got %d: %+v", code, resp)
+	}
+
+	if waited := time.Since(start); waited < 50*time.Millisecond {
+		t.Errorf("expected to wait for the timeout, waited %s", waited)
+	}
+
+	for _, body := range []string{
+		`{"timeout_ms": 50}`,
+		`{"expectation_uuid": "` + expUuid + `", "timeout_ms": -1}`,
+	} {
+		if code, _ := wait(body); code != http.StatusBadRequest {
+			t.Errorf("expected a bad request waiting with %s, got %d", body, code)
+		}
+	}
+
+	if code, _ := wait(`{"expectation_uuid": "` + uuid.NewV4().String() + `"}`); code != http.StatusNotFound {
+		t.Errorf("expected not found waiting for an unknown expectation, got %d", code)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	proxy, proxyServer, proxyClient := buildProxy()
+	defer proxyServer.Close()
+
+	server := &Server{Proxy: proxy}
+	proxy.OnRequest().DoFunc(server.handleProxyRequest)
+
+	controlServer := httptest.NewServer(server)
+	defer controlServer.Close()
+
+	cer := CreateExpectationsRequest{[]Expectation{
+		{
+			RequestCriteria: Criteria{{Type: CriteriaTypePath, Value: "/customers"}},
+			RespondWith:     RespondWith{Status: 201},
+		},
+		{
+			RequestCriteria: Criteria{{Type: CriteriaTypePath, Value: "/broken"}},
+			Fault:           FaultCloseConnection,
+		},
+	}}
+	created := createExpectations(t, server, &cer)
+
+	var bodies []io.Closer
+	defer func() {
+		for _, body := range bodies {
+			body.Close()
+		}
+	}()
+
+	subscribe := func(query string) *bufio.Reader {
+		resp, err := http.Get(controlServer.URL + "/events?" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+			t.Fatalf("unexpected response subscribing to events: %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+		}
+
+		// The stream only ends once the client goes away
+		bodies = append(bodies, resp.Body)
+
+		events := bufio.NewReader(resp.Body)
+
+		// Wait for the subscription to start
+		if line, err := events.ReadString('\n'); err != nil || line != ": connected\n" {
+			t.Fatalf("unexpected start of event stream: %q %v", line, err)
+		}
+		events.ReadString('\n')
+
+		return events
+	}
+
+	next := func(events *bufio.Reader) Event {
+		var event Event
+
+		for {
+			line, err := events.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if strings.HasPrefix(line, "data: ") {
+				if err := json.Unmarshal([]byte(line[len("data: "):]), &event); err != nil {
+					t.Fatal(err)
+				}
+
+				return event
+			}
+		}
+	}
+
+	all := subscribe("")
+	customers := subscribe("expectation_uuid=" + created[0].Uuid.String())
+
+	for _, path := range []string{"/unstubbed", "/broken", "/customers"} {
+		if resp, err := proxyClient.Get("http://example.com" + path); err == nil {
+			resp.Body.Close()
+		}
+	}
+
+	for i, expected := range []Event{
+		{Method: "GET", URL: "http://example.com/unstubbed", Status: http.StatusNotFound},
+		{Method: "GET", URL: "http://example.com/broken", Matched: true, ExpectationUuid: created[1].Uuid, Fault: FaultCloseConnection},
+		{Method: "GET", URL: "http://example.com/customers", Matched: true, ExpectationUuid: created[0].Uuid, Status: 201},
+	} {
+		event := next(all)
+
+		if event.Time.IsZero() || event.DurationMs < 0 {
+			t.Errorf("[%d] expected the event to be timed, got %+v", i, event)
+		}
+
+		event.Time, event.DurationMs = time.Time{}, 0
+
+		if !reflect.DeepEqual(event, expected) {
+			t.Errorf("[%d] expected event %+v, got %+v", i, expected, event)
+		}
+	}
+
+	if event := next(customers); event.URL != "http://example.com/customers" {
+		t.Errorf("expected only events of the expectation, got %+v", event)
+	}
+
+	resp, err := http.Get(controlServer.URL + "/events?expectation_uuid=nope")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected a bad request for an invalid expectation_uuid, got %d", resp.StatusCode)
+	}
+}
+
+func TestHARExport(t *testing.T) {
+	websiteServer := buildWebsiteServer()
+	defer websiteServer.Close()
+
+	proxy := goproxy.NewProxyHttpServer()
+
+	server := &Server{Proxy: proxy, requestStore: NewMemoryRequestStore(0)}
+	proxy.OnRequest().DoFunc(server.handleProxyRequest)
+	proxy.OnResponse().DoFunc(server.handleProxyResponse)
+
+	proxyServer := httptest.NewServer(server.ProxyHandler())
+	defer proxyServer.Close()
+
+	transport := &http.Transport{
+		Proxy: func(r *http.Request) (*url.URL, error) {
+			return url.Parse(proxyServer.URL)
+		},
+	}
+	defer transport.CloseIdleConnections()
+	proxyClient := &http.Client{Transport: transport}
+
+	cer := CreateExpectationsRequest{[]Expectation{
+		{
+			StoreMatchingRequests: true,
+			RequestCriteria:       Criteria{{Type: CriteriaTypePath, Value: "/customers"}},
+			RespondWith: RespondWith{
+				Status:  201,
+				Headers: map[string]string{"Content-Type": "application/json"},
+				Body:    `{"id": 1}`,
+				Delay:   &Delay{Milliseconds: 50},
+			},
+		},
+		{
+			RequestCriteria: Criteria{{Type: CriteriaTypePath, Value: "/broken"}},
+			Fault:           FaultCloseConnection,
+		},
+		{
+			RequestCriteria: Criteria{{Type: CriteriaTypeHost, Value: strings.TrimPrefix(websiteServer.URL, "http://")}},
+			PassThrough:     true,
+		},
+	}}
+	created := createExpectations(t, server, &cer)
+
+	resp, err := proxyClient.Post("http://example.com/customers?plan=gold", "application/json", strings.NewReader(`{"name": "Jane"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	// POSTed, as the client retries idempotent requests on closed connections
+	if resp, err := proxyClient.Post("http://example.com/broken", "text/plain", strings.NewReader("")); err == nil {
+		resp.Body.Close()
+		t.Fatal("expected the fault to fail the request")
+	}
+
+	resp, err = proxyClient.Get(websiteServer.URL + "/through")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	resp, err = proxyClient.Get("http://example.com/unstubbed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	export := func(query string) (int, HAR) {
+		req, err := http.NewRequest("GET", "/har?"+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+
+		var har HAR
+		json.Unmarshal(rec.Body.Bytes(), &har)
+		return rec.Code, har
+	}
+
+	code, har := export("")
+	if code != http.StatusOK || har.Log.Version != "1.2" || len(har.Log.Entries) != 4 {
+		t.Fatalf("unexpected HAR export: %d %+v", code, har)
+	}
+
+	stub, fault, passThrough, unmatched := har.Log.Entries[0], har.Log.Entries[1], har.Log.Entries[2], har.Log.Entries[3]
+
+	if stub.Request.Method != "POST" || stub.Request.URL != "http://example.com/customers?plan=gold" ||
+		!reflect.DeepEqual(stub.Request.QueryString, []HARNameValue{{"plan", "gold"}}) ||
+		stub.Request.PostData == nil || stub.Request.PostData.Text != `{"name": "Jane"}` || stub.Request.PostData.MimeType != "application/json" {
+		t.Errorf("unexpected HAR request: %+v", stub.Request)
+	}
+
+	if stub.Response.Status != 201 || stub.Response.StatusText != "Created" ||
+		stub.Response.Content.Text != `{"id": 1}` || stub.Response.Content.MimeType != "application/json" || stub.Response.Content.Size != 9 {
+		t.Errorf("unexpected HAR response: %+v", stub.Response)
+	}
+
+	if stub.Time < 50 || stub.Timings.Wait != stub.Time {
+		t.Errorf("expected the entry's time to include the delay, got: %v %+v", stub.Time, stub.Timings)
+	}
+
+	if stub.Comment != "expectation "+created[0].Uuid.String() {
+		t.Errorf("expected the entry to name its expectation, got %q", stub.Comment)
+	}
+
+	if fault.Response.Status != 0 || fault.Comment != "expectation "+created[1].Uuid.String()+", fault close_connection" {
+		t.Errorf("unexpected HAR entry for the fault: %+v", fault)
+	}
+
+	if passThrough.Response.Status != 200 || passThrough.Response.Content.Text != "Got Through" || passThrough.Time <= 0 {
+		t.Errorf("unexpected HAR entry for the pass through request: %+v", passThrough)
+	}
+
+	if unmatched.Request.URL != "http://example.com/unstubbed" || unmatched.Response.Status != http.StatusNotFound || unmatched.Comment != "" {
+		t.Errorf("unexpected HAR entry for the unmatched request: %+v", unmatched)
+	}
+
+	if code, har := export("expectation_uuid=" + created[0].Uuid.String()); code != http.StatusOK || len(har.Log.Entries) != 1 {
+		t.Errorf("expected only the expectation's requests, got %d: %+v", code, har)
+	}
+
+	if code, _ := export("expectation_uuid=nope"); code != http.StatusBadRequest {
+		t.Errorf("expected a bad request for an invalid expectation_uuid, got %d", code)
+	}
+}
+
+func TestVerifyOrder(t *testing.T) {
+	proxy, proxyServer, proxyClient := buildProxy()
+	defer proxyServer.Close()
+
+	server := &Server{Proxy: proxy}
+	proxy.OnRequest().DoFunc(server.handleProxyRequest)
+
+	cer := CreateExpectationsRequest{[]Expectation{
+		{RequestCriteria: Criteria{{Type: CriteriaTypePath, Value: "/customers"}}, RespondWith: RespondWith{Status: 201}},
+		{RequestCriteria: Criteria{{Type: CriteriaTypePath, Value: "/subscriptions"}}, RespondWith: RespondWith{Status: 201}},
+		{RequestCriteria: Criteria{{Type: CriteriaTypePath, Value: "/invoices"}}, RespondWith: RespondWith{Status: 201}},
+	}}
+	created := createExpectations(t, server, &cer)
+	customer, subscription, invoice := created[0].Uuid.String(), created[1].Uuid.String(), created[2].Uuid.String()
+	missing := uuid.NewV4().String()
+
+	for _, path := range []string{"/customers", "/unstubbed", "/invoices", "/subscriptions"} {
+		resp, err := proxyClient.Post("http://example.com"+path, "application/json", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	testCases := []struct {
+		uuids   []string
+		passed  bool
+		matches int
+		message string
+	}{
+		{[]string{customer, subscription}, true, 2, ""},
+		{[]string{customer, invoice, subscription}, true, 3, ""},
+		{[]string{customer, subscription, invoice}, false, 2, "expectation " + invoice + " was matched out of order"},
+		{[]string{subscription, customer}, false, 1, "expectation " + customer + " was matched out of order"},
+		{[]string{customer, missing}, false, 1, "expectation " + missing + " was never matched"},
+		{[]string{missing}, false, 0, "expectation " + missing + " was never matched"},
+	}
+
+	for i, tc := range testCases {
+		body, _ := json.Marshal(map[string][]string{"expectation_uuids": tc.uuids})
+
+		req, err := http.NewRequest("POST", "/verify/order", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+
+		var resp VerifyOrderResponse
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+
+		if rec.Code != http.StatusOK || resp.Passed != tc.passed || len(resp.Matches) != tc.matches || !strings.Contains(resp.Message, tc.message) {
+			t.Errorf("[%d] unexpected response: %d %+v", i, rec.Code, resp)
+		}
+	}
+}
+
+func TestUnmatchedRequests(t *testing.T) {
+	proxy, proxyServer, proxyClient := buildProxy()
+	defer proxyServer.Close()
+
+	server := &Server{Proxy: proxy}
+	proxy.OnRequest().DoFunc(server.handleProxyRequest)
+
+	cer := CreateExpectationsRequest{[]Expectation{
+		{RequestCriteria: Criteria{{Type: CriteriaTypePath, Value: "/stubbed"}}, RespondWith: RespondWith{Status: 200}},
+	}}
+	createExpectations(t, server, &cer)
+
+	for _, path := range []string{"/stubbed", "/unstubbed"} {
+		req, err := http.NewRequest("PUT", "http://example.com"+path, strings.NewReader("Hello World"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Request-Id", "abc123")
+
+		resp, err := proxyClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	unmatched := func() []JournalEntry {
+		req, err := http.NewRequest("GET", "/requests/unmatched", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+
+		var resp UnmatchedResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+
+		return resp.Requests
+	}
+
+	entries := unmatched()
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 unmatched request, got: %d", len(entries))
+	}
+
+	entry := entries[0]
+	if entry.Method != "PUT" || entry.URL != "http://example.com/unstubbed" || entry.BodyBase64 != "SGVsbG8gV29ybGQ=" ||
+		http.Header(entry.Headers).Get("X-Request-Id") != "abc123" || entry.Time.IsZero() {
+		t.Errorf("unexpected unmatched request: %+v", entry)
+	}
+
+	req, err := http.NewRequest("DELETE", "/requests/unmatched", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	rec := httptest.NewRecorder()
 	server.ServeHTTP(rec, req)
 
 	if rec.Code != http.StatusOK {
-		t.Errorf("unexpected status code %d when finding requests with uuid %s", rec.Code, exp[0].Uuid)
+		t.Errorf("expected DELETE to respond 200, got: %d", rec.Code)
 	}
 
-	findResponse := FindResponse{}
-	if err := json.NewDecoder(rec.Body).Decode(&findResponse); err != nil {
-		t.Fatal(err)
+	if entries := unmatched(); len(entries) != 0 {
+		t.Errorf("expected no unmatched requests after clearing them, got: %d", len(entries))
 	}
+}
 
-	if !reflect.DeepEqual(findResponse, FindResponse{
-		Requests: []Request{
-			{
-				URL:    "http://www.geckoboard.com/hello-world",
-				Method: "POST",
-				Headers: map[string][]string{
-					"Accept-Encoding": []string{"gzip"},
-					"Content-Length":  []string{"10"},
-					"X-Some-Header":   []string{"Hello World"},
-					"User-Agent":      []string{"Awesome User Agent"},
-				},
-				BodyBase64: "U29tZSBTdHVmZg==",
+func TestNearMisses(t *testing.T) {
+	proxy, proxyServer, proxyClient := buildProxy()
+	defer proxyServer.Close()
+
+	server := &Server{Proxy: proxy, nearMissesInResponse: true}
+	proxy.OnRequest().DoFunc(server.handleProxyRequest)
+
+	cer := CreateExpectationsRequest{[]Expectation{
+		{
+			RequestCriteria: Criteria{
+				{Type: CriteriaTypeHost, Value: "example.com"},
+				{Type: CriteriaTypePath, Value: "/v1/users"},
+				{Type: CriteriaTypeHeader, Key: "Authorization", MatchType: MatchTypeRegex, Value: "Bearer .+"},
 			},
+			RespondWith: RespondWith{Status: 200},
 		},
-	}) {
-		t.Errorf("unexpected response from /expectations/%s/requests endpoint: %#v", expectations[0].Uuid, findResponse)
+		{
+			RequestCriteria: Criteria{
+				{Type: CriteriaTypeHost, Value: "example.com"},
+				{Type: CriteriaTypePath, Value: "/v1/user"},
+			},
+			MaxMatches:  1,
+			RespondWith: RespondWith{Status: 200},
+		},
+		{
+			RequestCriteria: Criteria{{Type: CriteriaTypeHost, Value: "other.com"}},
+			RespondWith:     RespondWith{Status: 200},
+		},
+	}}
+	created := createExpectations(t, server, &cer)
+
+	get := func() (int, string) {
+		resp, err := proxyClient.Get("http://example.com/v1/user")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	if status, _ := get(); status != http.StatusOK {
+		t.Fatalf("expected the first request to match, got: %d", status)
+	}
+
+	status, body := get()
+	if status != http.StatusNotFound {
+		t.Fatalf("expected the second request to be unmatched, got: %d", status)
+	}
+
+	expectedLines := []string{
+		"everdeen: no expectation matched request",
+		created[1].Uuid.String() + ": 2 criteria matched but max_matches of 1 reached",
+		created[0].Uuid.String() + `: 1 criteria matched, path expected "/v1/users" got "/v1/user", header Authorization expected to match "Bearer .+" got nothing`,
+	}
+
+	for _, line := range expectedLines {
+		if !strings.Contains(body, line) {
+			t.Errorf("expected the response body to contain %q, got: %s", line, body)
+		}
+	}
+
+	if strings.Contains(body, created[2].Uuid.String()) {
+		t.Errorf("expected expectations with no matching criteria to be left out, got: %s", body)
+	}
+
+	entries := server.unmatched.Entries()
+	if len(entries) != 1 || len(entries[0].NearMisses) != 2 {
+		t.Fatalf("expected the near misses to be journaled, got: %+v", entries)
+	}
+
+	mismatch := entries[0].NearMisses[1].Failed[0]
+	if mismatch.Type != CriteriaTypePath || mismatch.Expected != `"/v1/users"` || mismatch.Actual != `"/v1/user"` {
+		t.Errorf("unexpected mismatch: %+v", mismatch)
+	}
+
+	server.nearMissesInResponse = false
+
+	if _, body := get(); body != blockedResponse.body {
+		t.Errorf("expected the plain 404 body without near misses in the response, got: %s", body)
+	}
+}
+
+func TestSessions(t *testing.T) {
+	proxy, proxyServer, proxyClient := buildProxy()
+	defer proxyServer.Close()
+
+	server := &Server{Proxy: proxy}
+	proxy.OnRequest().DoFunc(server.handleProxyRequest)
+
+	control := func(method, path, body string) *httptest.ResponseRecorder {
+		return serveControl(t, server, method, path, body)
+	}
+
+	createSession := func() string {
+		var resp SessionResponse
+		json.Unmarshal(control("POST", "/sessions", "").Body.Bytes(), &resp)
+		return resp.Id
+	}
+
+	sessionA, sessionB := createSession(), createSession()
+	if sessionA == "" || sessionA == sessionB {
+		t.Fatalf("expected two distinct sessions, got: %q and %q", sessionA, sessionB)
+	}
+
+	expectation := func(path, body string) string {
+		return `{"expectations": [{"request_criteria": [{"type": "path", "value": "` + path + `"}], "respond_with": {"status": 200, "body": "` + body + `"}}]}`
+	}
+
+	for _, create := range []struct{ session, path, body string }{
+		{"", "/shared", "global"},
+		{sessionA, "/shared", "session a"},
+		{sessionB, "/only-b", "session b"},
+	} {
+		if rec := control("POST", "/expectations?session="+create.session, expectation(create.path, create.body)); rec.Code != http.StatusOK {
+			t.Fatalf("unexpected status creating expectations: %d %s", rec.Code, rec.Body)
+		}
+	}
+
+	if rec := control("POST", "/expectations?session=unknown", expectation("/", "")); rec.Code != http.StatusNotFound {
+		t.Errorf("expected creating expectations in an unknown session to respond 404, got: %d", rec.Code)
+	}
+
+	get := func(path string, headers map[string]string) (int, string) {
+		return proxyGet(t, proxyClient, "http://example.com"+path, headers)
+	}
+
+	inA := map[string]string{"X-Everdeen-Session": sessionA}
+	inB := map[string]string{"Proxy-Authorization": "Basic " + base64.StdEncoding.EncodeToString([]byte(sessionB+":"))}
+
+	testCases := []struct {
+		path    string
+		headers map[string]string
+		status  int
+		body    string
+	}{
+		{"/shared", inA, 200, "session a"},
+		{"/shared", inB, 200, "global"},
+		{"/shared", nil, 200, "global"},
+		{"/only-b", inB, 200, "session b"},
+		{"/only-b", inA, 404, blockedResponse.body},
+		{"/only-b", nil, 404, blockedResponse.body},
+	}
+
+	for i, tc := range testCases {
+		if status, body := get(tc.path, tc.headers); status != tc.status || body != tc.body {
+			t.Errorf("[%d] expected %d %q, got: %d %q", i, tc.status, tc.body, status, body)
+		}
+	}
+
+	var exps []*Expectation
+	json.Unmarshal(control("GET", "/expectations?session="+sessionA, "").Body.Bytes(), &exps)
+	if len(exps) != 1 || exps[0].Session != sessionA {
+		t.Errorf("expected only session a's expectation to be listed, got: %+v", exps)
+	}
+
+	var unmatched UnmatchedResponse
+	json.Unmarshal(control("GET", "/requests/unmatched?session="+sessionA, "").Body.Bytes(), &unmatched)
+	if len(unmatched.Requests) != 1 || unmatched.Requests[0].Session != sessionA {
+		t.Errorf("expected only session a's unmatched request to be listed, got: %+v", unmatched.Requests)
+	}
+
+	for _, entry := range server.journal.SessionEntries(sessionB) {
+		if entry.Headers["Proxy-Authorization"] != nil {
+			t.Errorf("expected session b's requests to be journaled without their proxy credentials, got: %v", entry.Headers)
+		}
+	}
+
+	if rec := control("DELETE", "/reset/all?session="+sessionA, ""); rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status resetting session a: %d", rec.Code)
+	}
+
+	if _, body := get("/shared", inA); body != "global" {
+		t.Errorf("expected session a's expectation to be reset, got: %q", body)
+	}
+
+	if _, body := get("/only-b", inB); body != "session b" {
+		t.Errorf("expected session b's expectation to survive resetting session a, got: %q", body)
+	}
+
+	if rec := control("DELETE", "/sessions/"+sessionB, ""); rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status deleting session b: %d", rec.Code)
+	}
+
+	if status, _ := get("/only-b", inB); status != http.StatusNotFound {
+		t.Errorf("expected session b's expectation to be deleted with it, got: %d", status)
+	}
+
+	if rec := control("DELETE", "/sessions/"+sessionB, ""); rec.Code != http.StatusNotFound {
+		t.Errorf("expected deleting an unknown session to respond 404, got: %d", rec.Code)
+	}
+
+	if exps := listsExpectationsResponse(t, server); len(exps) != 1 || exps[0].Session != "" {
+		t.Errorf("expected only the global expectation to remain, got: %+v", exps)
+	}
+}
+
+func TestHTTPSSessions(t *testing.T) {
+	useTestCA(t)
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+
+	server := &Server{Proxy: proxy}
+	proxy.OnRequest().DoFunc(server.handleProxyRequest)
+
+	proxyServer := httptest.NewServer(server.ProxyHandler())
+	defer proxyServer.Close()
+
+	control := func(method, path, body string) *httptest.ResponseRecorder {
+		return serveControl(t, server, method, path, body)
+	}
+
+	var sessionA, sessionB SessionResponse
+	json.Unmarshal(control("POST", "/sessions", "").Body.Bytes(), &sessionA)
+	json.Unmarshal(control("POST", "/sessions", "").Body.Bytes(), &sessionB)
+
+	var created []*Expectation
+	rec := control("POST", "/expectations?session="+sessionA.Id, `{"expectations": [
+		{"request_criteria": [{"type": "path", "value": "/first"}], "respond_with": {"status": 200, "body": "first"}},
+		{"request_criteria": [{"type": "path", "value": "/second"}], "respond_with": {"status": 200, "body": "second"}}
+	]}`)
+	if err := json.Unmarshal(rec.Body.Bytes(), &created); err != nil || len(created) != 2 {
+		t.Fatalf("unexpected response creating expectations: %d %s", rec.Code, rec.Body)
+	}
+
+	// The session is only given by the credentials of the CONNECT request,
+	// the MITM'd requests read from the tunnel carry none
+	get := func(session, path string) (int, string) {
+		proxyURL, _ := url.Parse(proxyServer.URL)
+		if session != "" {
+			proxyURL.User = url.User(session)
+		}
+
+		transport := &http.Transport{
+			Proxy:           http.ProxyURL(proxyURL),
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}
+		defer transport.CloseIdleConnections()
+
+		return proxyGet(t, &http.Client{Transport: transport}, "https://example.com"+path, nil)
+	}
+
+	if status, body := get(sessionA.Id, "/first"); status != 200 || body != "first" {
+		t.Errorf("expected the session's expectation to match, got: %d %q", status, body)
+	}
+
+	if status, _ := get("", "/first"); status != http.StatusNotFound {
+		t.Errorf("expected the session's expectation not to match outside the session, got: %d", status)
 	}
-}
 
-func TestRequestsReturnsNotFoundWhenUuidNotExists(t *testing.T) {
-	proxy, proxyServer, _ := buildProxy()
-	defer proxyServer.Close()
+	if status, _ := get(sessionB.Id, "/second"); status != http.StatusNotFound {
+		t.Errorf("expected the session's expectation not to match in another session, got: %d", status)
+	}
 
-	server := &Server{Proxy: proxy}
-	proxy.OnRequest().DoFunc(server.handleProxyRequest)
+	get(sessionA.Id, "/second")
 
-	req, err := http.NewRequest("GET", "/expectations/1293/requests", nil)
-	if err != nil {
-		t.Fatal(err)
+	order := `{"expectation_uuids": ["` + created[0].Uuid.String() + `", "` + created[1].Uuid.String() + `"]}`
+
+	verifyOrder := func(session string) VerifyOrderResponse {
+		var resp VerifyOrderResponse
+		rec := control("POST", "/verify/order?session="+session, order)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("unexpected status verifying the order: %d %s", rec.Code, rec.Body)
+		}
+
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		return resp
 	}
 
-	rec := httptest.NewRecorder()
-	server.ServeHTTP(rec, req)
+	if resp := verifyOrder(sessionA.Id); !resp.Passed || len(resp.Matches) != 2 || resp.Matches[0].Session != sessionA.Id {
+		t.Errorf("expected the order to be verified in the session, got: %+v", resp)
+	}
 
-	if rec.Code != http.StatusNotFound {
-		t.Errorf("unexpected status code %d with request id that doesn't exist", rec.Code)
+	if resp := verifyOrder(sessionB.Id); resp.Passed {
+		t.Errorf("expected the order not to be verified in another session, got: %+v", resp)
+	}
+
+	if rec := control("POST", "/verify/order?session=unknown", order); rec.Code != http.StatusNotFound {
+		t.Errorf("expected verifying the order in an unknown session to respond 404, got: %d", rec.Code)
 	}
 }
 
-func TestRequestReturnsEmptyArrayWithNoMatchingRequests(t *testing.T) {
+func TestExpiringExpectations(t *testing.T) {
 	proxy, proxyServer, proxyClient := buildProxy()
 	defer proxyServer.Close()
 
 	server := &Server{Proxy: proxy}
 	proxy.OnRequest().DoFunc(server.handleProxyRequest)
 
-	//Setup an expectation that isn't going to match
-	expectations := []Expectation{
+	expiresAt := time.Now().Add(-time.Second)
+
+	cer := CreateExpectationsRequest{[]Expectation{
 		{
+			RequestCriteria:       Criteria{{Type: CriteriaTypePath, Value: "/ttl"}},
+			RespondWith:           RespondWith{Status: 200, Body: "ttl"},
+			TTLSeconds:            60,
+			StoreMatchingRequests: true,
+		},
+		{
+			RequestCriteria:       Criteria{{Type: CriteriaTypePath, Value: "/expired"}},
+			RespondWith:           RespondWith{Status: 200, Body: "expired"},
+			ExpiresAt:             &expiresAt,
 			StoreMatchingRequests: true,
-			RequestCriteria: Criteria{
-				{
-					Type:  CriteriaTypeHost,
-					Value: "www.google.com",
-				},
-			},
-			RespondWith: RespondWith{
-				Status:       http.StatusOK,
-				Body:         "Its me!!!",
-				BodyEncoding: BodyEncodingNone,
-			},
 		},
+	}}
+	created := createExpectations(t, server, &cer)
+
+	if created[0].TTLSeconds != 0 || created[0].ExpiresAt == nil || created[0].ExpiresAt.Sub(time.Now()) < 59*time.Second {
+		t.Errorf("expected ttl_seconds to be turned into expires_at, got: %v %v", created[0].TTLSeconds, created[0].ExpiresAt)
 	}
 
-	cer := CreateExpectationsRequest{expectations}
-	exp := createExpectations(t, server, &cer)
+	get := func(path string) int {
+		resp, err := proxyClient.Get("http://example.com" + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
 
-	if uuid.Equal(exp[0].Uuid, uuid.Nil) {
-		t.Fatalf("Expected exp returned to have uuid but it did not %s", exp[0].Uuid)
+		return resp.StatusCode
 	}
 
-	req, err := http.NewRequest("GET", "http://www.geckoboard.com/hello-world", nil)
-	if err != nil {
-		t.Fatal(err)
+	if status := get("/ttl"); status != http.StatusOK {
+		t.Errorf("expected the unexpired expectation to match, got: %d", status)
 	}
 
-	_, err = proxyClient.Do(req)
+	if status := get("/expired"); status != http.StatusNotFound {
+		t.Errorf("expected the expired expectation not to match, got: %d", status)
+	}
+
+	exps := listsExpectationsResponse(t, server)
+	if len(exps) != 2 || exps[0].Expired || !exps[1].Expired {
+		t.Fatalf("expected only the second expectation to be listed as expired, got: %+v", exps)
+	}
+
+	server.collectExpired(time.Now())
+
+	exps = listsExpectationsResponse(t, server)
+	if len(exps) != 1 || !uuid.Equal(exps[0].Uuid, created[0].Uuid) {
+		t.Errorf("expected the expired expectation to be collected, got: %+v", exps)
+	}
+
+	req, err := http.NewRequest("GET", "/ttl", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	req, err = http.NewRequest("GET", "/expectations/"+exp[0].Uuid.String()+"/requests", nil)
+	saveRequest(server.store(), created[0].Uuid, req)
+	server.collectExpired(created[0].ExpiresAt.Add(time.Second))
+
+	if exps := listsExpectationsResponse(t, server); len(exps) != 0 {
+		t.Errorf("expected every expectation to be collected once expired, got: %d", len(exps))
+	}
+
+	if found, _ := server.store().Where(created[0].Uuid); len(found) != 0 {
+		t.Errorf("expected the stored requests of collected expectations to be deleted, got: %d", len(found))
+	}
+
+	cer = CreateExpectationsRequest{[]Expectation{{TTLSeconds: -1}}}
+	data, _ := json.Marshal(cer)
+
+	req, err = http.NewRequest("POST", "/expectations", bytes.NewReader(data))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -909,123 +3288,357 @@ func TestRequestReturnsEmptyArrayWithNoMatchingRequests(t *testing.T) {
 	rec := httptest.NewRecorder()
 	server.ServeHTTP(rec, req)
 
-	if rec.Code != http.StatusOK {
-		t.Errorf("unexpected status code %d with expectation uuid %s", rec.Code, exp[0].Uuid)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected a negative ttl_seconds to respond 400, got: %d", rec.Code)
 	}
+}
 
-	if strings.TrimRight(rec.Body.String(), `\n\t`) == `{"requests":[]}` {
-		t.Errorf("unexpected response from /expectations/%s/requests endpoint: '%#s'", exp[0].Uuid, rec.Body.String())
+func listsExpectationsResponse(t *testing.T, server *Server) []*Expectation {
+	req, err := http.NewRequest("GET", "/expectations", nil)
+	if err != nil {
+		t.Fatal(err)
 	}
-}
 
-func buildProxy() (*goproxy.ProxyHttpServer, *httptest.Server, *http.Client) {
-	proxy := goproxy.NewProxyHttpServer()
-	proxyServer := httptest.NewServer(proxy)
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, req)
 
-	client := &http.Client{
-		Transport: &http.Transport{
-			Proxy: func(r *http.Request) (*url.URL, error) {
-				return url.Parse(proxyServer.URL)
-			},
-		},
-	}
+	var exps []*Expectation
+	json.Unmarshal(rec.Body.Bytes(), &exps)
 
-	return proxy, proxyServer, client
+	return exps
 }
 
-func buildWebsiteServer() *httptest.Server {
-	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprint(w, "Got Through")
-	}))
-}
+func TestTemplatedResponseHelpers(t *testing.T) {
+	proxy, proxyServer, proxyClient := buildProxy()
+	defer proxyServer.Close()
 
-func createExpectations(t *testing.T, server *Server, cer *CreateExpectationsRequest) []*Expectation {
-	data, err := json.Marshal(cer)
+	server := &Server{Proxy: proxy}
+	proxy.OnRequest().DoFunc(server.handleProxyRequest)
+
+	cer := CreateExpectationsRequest{[]Expectation{
+		{
+			RespondWith: RespondWith{
+				Status:    200,
+				Templated: true,
+				Body:      `{{ uuid }} {{ now "2006" }} {{ unixTime }}`,
+			},
+		},
+	}}
+	createExpectations(t, server, &cer)
 
+	resp, err := proxyClient.Get("http://www.geckoboard.com/")
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	req, err := http.NewRequest("POST", "/expectations", bytes.NewReader(data))
+	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	rec := httptest.NewRecorder()
-	server.ServeHTTP(rec, req)
-
-	if rec.Code != http.StatusOK {
-		t.Fatalf("Unexpected status code [ %d ] while setting up expectations", rec.Code)
+	fields := strings.Fields(string(body))
+	if len(fields) != 3 {
+		t.Fatalf("unexpected templated response body: %s", body)
 	}
 
-	var expectations []*Expectation
-	err = json.Unmarshal(rec.Body.Bytes(), &expectations)
+	if _, err := uuid.FromString(fields[0]); err != nil {
+		t.Errorf("expected a uuid in templated response but got %s: %v", fields[0], err)
+	}
 
-	if err != nil {
-		t.Fatal(err)
+	if fields[1] != strconv.Itoa(time.Now().UTC().Year()) {
+		t.Errorf("expected the current year in templated response but got %s", fields[1])
 	}
 
-	return expectations
+	if _, err := strconv.ParseInt(fields[2], 10, 64); err != nil {
+		t.Errorf("expected a unix timestamp in templated response but got %s", fields[2])
+	}
 }
 
-func TestResetAllEndpointRequest(t *testing.T) {
-	proxy, proxyServer, _ := buildProxy()
+func TestDelayedResponses(t *testing.T) {
+	websiteServer := buildWebsiteServer()
+	defer websiteServer.Close()
+
+	proxy, proxyServer, proxyClient := buildProxy()
 	defer proxyServer.Close()
 
 	server := &Server{Proxy: proxy}
 	proxy.OnRequest().DoFunc(server.handleProxyRequest)
 
-	expectations := []Expectation{
+	delay := &Delay{Milliseconds: 100}
+
+	cer := CreateExpectationsRequest{[]Expectation{
 		{
-			RequestCriteria: Criteria{
+			RequestCriteria: Criteria{{Type: CriteriaTypeMethod, Value: "GET"}},
+			RespondWith:     RespondWith{Status: 418, Body: "Proxy Response", Delay: delay},
+		},
+		{
+			RequestCriteria: Criteria{{Type: CriteriaTypeMethod, Value: "POST"}},
+			RespondWith:     RespondWith{Delay: delay},
+			PassThrough:     true,
+		},
+	}}
+	createExpectations(t, server, &cer)
+
+	for _, method := range []string{"GET", "POST"} {
+		req, err := http.NewRequest(method, websiteServer.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		start := time.Now()
+
+		resp, err := proxyClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+			t.Errorf("expected %s request to be delayed by at least 100ms but took %s", method, elapsed)
+		}
+	}
+}
+
+func TestFaultInjection(t *testing.T) {
+	useTestCA(t)
+
+	testCases := []struct {
+		fault       Fault
+		requestErr  bool
+		status      int
+		bodyErr     bool
+		errContains string
+	}{
+		{fault: FaultCloseConnection, requestErr: true},
+		{fault: FaultResetConnection, requestErr: true},
+		{fault: FaultMalformedStatus, requestErr: true, errContains: "malformed HTTP"},
+		{fault: FaultTruncatedBody, status: 200, bodyErr: true},
+		{fault: FaultHangAfterHeaders, status: 503, bodyErr: true},
+	}
+
+	for _, scheme := range []string{"http", "https"} {
+		for _, tc := range testCases {
+			proxy := goproxy.NewProxyHttpServer()
+			proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+
+			server := &Server{Proxy: proxy, faultHangTimeout: 100 * time.Millisecond}
+			proxy.OnRequest().DoFunc(server.handleProxyRequest)
+
+			proxyServer := httptest.NewServer(server.ProxyHandler())
+			transport := &http.Transport{
+				Proxy: func(r *http.Request) (*url.URL, error) {
+					return url.Parse(proxyServer.URL)
+				},
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			}
+			proxyClient := &http.Client{Transport: transport}
+
+			status := tc.status
+			if status == 0 {
+				status = 200
+			}
+
+			cer := CreateExpectationsRequest{[]Expectation{
 				{
-					Type:  CriteriaTypeHost,
-					Value: "www.google.com",
+					RespondWith: RespondWith{Status: tc.status, Body: "Proxy Response"},
+					Fault:       tc.fault,
 				},
-			},
-		},
+			}}
+			createExpectations(t, server, &cer)
+
+			resp, err := proxyClient.Get(scheme + "://www.geckoboard.com/")
+
+			if tc.requestErr {
+				if err == nil {
+					t.Errorf("[%s %s] expected request to fail but got status %d", scheme, tc.fault, resp.StatusCode)
+					resp.Body.Close()
+				} else if !strings.Contains(err.Error(), tc.errContains) {
+					t.Errorf("[%s %s] expected error containing %q but got: %v", scheme, tc.fault, tc.errContains, err)
+				}
+			} else if err != nil {
+				t.Errorf("[%s %s] unexpected error: %v", scheme, tc.fault, err)
+			} else {
+				if resp.StatusCode != status {
+					t.Errorf("[%s %s] unexpected response status, expected: %d, got: %d", scheme, tc.fault, status, resp.StatusCode)
+				}
+
+				if _, err := ioutil.ReadAll(resp.Body); tc.bodyErr && err == nil {
+					t.Errorf("[%s %s] expected an error reading the response body but got none", scheme, tc.fault)
+				}
+
+				resp.Body.Close()
+			}
+
+			// Close the client's side of any connections the fault left open
+			transport.CloseIdleConnections()
+			proxyServer.Close()
+		}
 	}
+}
 
-	cer := CreateExpectationsRequest{expectations}
+func TestRecordingPassThroughTraffic(t *testing.T) {
+	websiteServer := buildWebsiteServer()
+
+	proxy, proxyServer, proxyClient := buildProxy()
+	defer proxyServer.Close()
+
+	server := &Server{Proxy: proxy}
+	proxy.OnRequest().DoFunc(server.handleProxyRequest)
+	proxy.OnResponse().DoFunc(server.handleProxyResponse)
+
+	cer := CreateExpectationsRequest{[]Expectation{{PassThrough: true}}}
 	createExpectations(t, server, &cer)
 
-	// Check that one expectation exists
-	exps := listsExpectationsResponse(t, server)
-	if len(exps) != 1 {
-		t.Errorf("Expected one expectation to be returned but got %d", len(exps))
+	controlRequest := func(method, path string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusOK {
+			t.Fatalf("unexpected status code %d from %s %s", rec.Code, method, path)
+		}
+
+		return rec
 	}
 
-	// Now post to the reset_all endpoint
-	req, err := http.NewRequest("DELETE", "/reset/all", nil)
-	if err != nil {
+	proxyRequest := func(method, path, body string) string {
+		req, err := http.NewRequest(method, websiteServer.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp, err := proxyClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return string(b)
+	}
+
+	proxyRequest("GET", "/not-recorded", "")
+
+	controlRequest("POST", "/recordings/start")
+	proxyRequest("GET", "/users?page=2", "")
+	proxyRequest("GET", "/users?page=2", "")
+	proxyRequest("POST", "/users", `{"name": "Katniss"}`)
+	controlRequest("POST", "/recordings/stop")
+
+	proxyRequest("GET", "/not-recorded-either", "")
+
+	var recorded CreateExpectationsRequest
+	if err := json.NewDecoder(controlRequest("GET", "/recordings").Body).Decode(&recorded); err != nil {
 		t.Fatal(err)
 	}
 
-	rec := httptest.NewRecorder()
-	server.ServeHTTP(rec, req)
+	if len(recorded.Expectations) != 2 {
+		t.Fatalf("expected 2 recorded expectations but got %d", len(recorded.Expectations))
+	}
 
-	if rec.Code != 200 {
-		t.Errorf("Expected 200 response code to /reset_all but got %d", rec.Code)
+	if n := len(recorded.Expectations[0].RespondWithSequence); n != 2 {
+		t.Errorf("expected the repeated request to be recorded with a sequence of 2 responses but got %d", n)
 	}
 
-	// Now query the expectations endpoint and verify none exist
-	exps = listsExpectationsResponse(t, server)
-	if len(exps) != 0 {
-		t.Errorf("Expected no expectations to be returned but got %d", len(exps))
+	if rw := recorded.Expectations[1].RespondWith; rw.Status != 200 || rw.Body != "Got Through" {
+		t.Errorf("unexpected recorded response: %+v", rw)
 	}
-}
 
-func listsExpectationsResponse(t *testing.T, server *Server) []*Expectation {
-	req, err := http.NewRequest("GET", "/expectations", nil)
-	if err != nil {
+	// Replay the recording without the real server
+	websiteServer.Close()
+	controlRequest("DELETE", "/reset/all")
+	createExpectations(t, server, &recorded)
+
+	if body := proxyRequest("POST", "/users", `{ "name":"Katniss" }`); body != "Got Through" {
+		t.Errorf("unexpected response replaying recording: %s", body)
+	}
+
+	controlRequest("DELETE", "/recordings")
+
+	if err := json.NewDecoder(controlRequest("GET", "/recordings").Body).Decode(&recorded); err != nil {
 		t.Fatal(err)
 	}
 
-	rec := httptest.NewRecorder()
-	server.ServeHTTP(rec, req)
+	if len(recorded.Expectations) != 0 {
+		t.Errorf("expected recordings to be reset but got %d", len(recorded.Expectations))
+	}
+}
 
-	var exps []*Expectation
-	json.Unmarshal(rec.Body.Bytes(), &exps)
+func TestCreateExpectationsRejectsInvalidCriteria(t *testing.T) {
+	server := &Server{}
+
+	for _, criterion := range []Criterion{
+		{Type: CriteriaTypePath, MatchType: MatchTypeRegex, Value: "/users/(["},
+		{Type: CriteriaTypeJSONPath, Key: "customer.id", Value: "cus_123"},
+		{Type: CriteriaTypeBody, MatchType: MatchTypeJSONEqual, Value: `{"name": `},
+		{Type: CriteriaTypeHeader, Key: "Content-Type", MatchType: MatchTypeJSONContains, Value: `{}`},
+		{Type: CriteriaTypeAnyOf},
+		{Type: CriteriaTypeAllOf, Criteria: Criteria{{Type: CriteriaTypeHost, MatchType: MatchTypeRegex, Value: "("}}},
+		{Type: "anyof", Criteria: Criteria{{Type: CriteriaTypePath, Value: "/"}}},
+		{Type: "", Value: "/"},
+		{Type: CriteriaTypeMethod, MatchType: MatchTypeRegex, Value: "GET|POST"},
+		{Type: CriteriaTypePath, MatchType: "glob", Value: "/*"},
+		{Type: CriteriaTypeNoneOf, Criteria: Criteria{{Type: CriteriaTypeMethod, MatchType: MatchTypeRegex, Value: "GET"}}},
+	} {
+		data, err := json.Marshal(CreateExpectationsRequest{
+			Expectations: []Expectation{{RequestCriteria: Criteria{&criterion}}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
 
-	return exps
+		req, err := http.NewRequest("POST", "/expectations", bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("expected status %d creating expectation with criterion %+v but got %d", http.StatusBadRequest, criterion, rec.Code)
+		}
+	}
+
+	if exps := listsExpectationsResponse(t, server); len(exps) != 0 {
+		t.Errorf("expected no expectations to be registered but got %d", len(exps))
+	}
+}
+
+func TestCreateExpectationsRejectsInvalidResponses(t *testing.T) {
+	server := &Server{}
+
+	for _, rw := range []RespondWith{
+		{Templated: true, Body: "{{ .Query.Get "},
+		{Templated: true, Headers: map[string]string{"Location": "{{ nope }}"}},
+		{Templated: true, Body: "e3sgdXVpZCB9fQ==", BodyEncoding: BodyEncodingBase64},
+		{Delay: &Delay{Distribution: "exponential"}},
+	} {
+		data, err := json.Marshal(CreateExpectationsRequest{
+			Expectations: []Expectation{{RespondWith: rw}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := http.NewRequest("POST", "/expectations", bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("expected status %d creating expectation responding with %+v but got %d", http.StatusBadRequest, rw, rec.Code)
+		}
+	}
 }
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/satori/go.uuid"
+)
+
+// expectationSource is where an expectation loaded from the expectations
+// directory came from, so that reloads can tell whether it has changed.
+type expectationSource struct {
+	file   string
+	index  int
+	digest [sha1.Size]byte
+}
+
+type expectationSourceKey struct {
+	file  string
+	index int
+}
+
+func (src *expectationSource) key() expectationSourceKey {
+	return expectationSourceKey{file: src.file, index: src.index}
+}
+
+// loadExpectationsFile reads a JSON file in the same shape as the body of
+// `POST /expectations`.
+func loadExpectationsFile(path string) ([]*Expectation, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseExpectationsFile(path, data)
+}
+
+func parseExpectationsFile(path string, data []byte) ([]*Expectation, error) {
+	var request CreateExpectationsRequest
+	if err := json.NewDecoder(bytes.NewReader(data)).Decode(&request); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	expectations, err := prepareExpectations(request)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	return expectations, nil
+}
+
+// loadExpectationsDir loads every `.json` file in dir, in file name order.
+func loadExpectationsDir(dir string) ([]*Expectation, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, file := range files {
+		if !file.IsDir() && filepath.Ext(file.Name()) == ".json" {
+			names = append(names, file.Name())
+		}
+	}
+	sort.Strings(names)
+
+	expectations := []*Expectation{}
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		loaded, err := parseExpectationsFile(path, data)
+		if err != nil {
+			return nil, err
+		}
+
+		digest := sha1.Sum(data)
+		for i, expectation := range loaded {
+			expectation.source = &expectationSource{file: name, index: i, digest: digest}
+		}
+
+		expectations = append(expectations, loaded...)
+	}
+
+	return expectations, nil
+}
+
+// replaceFileExpectations swaps the expectations loaded from the
+// expectations directory for a freshly loaded set, leaving expectations
+// created through the API where they are. Expectations from files that
+// haven't changed are kept as they were, along with their UUID and matches,
+// while the stored requests of those that are gone are deleted.
+func (s *Server) replaceFileExpectations(loaded []*Expectation) {
+	s.mutex.Lock()
+
+	previous := map[expectationSourceKey]*Expectation{}
+	for _, expectation := range s.expectations {
+		if expectation.source != nil {
+			previous[expectation.source.key()] = expectation
+		}
+	}
+
+	for i, expectation := range loaded {
+		key := expectation.source.key()
+
+		if old, ok := previous[key]; ok && old.source.digest == expectation.source.digest {
+			loaded[i] = old
+			delete(previous, key)
+			continue
+		}
+
+		expectation.Uuid = uuid.NewV4()
+	}
+
+	expectations := make([]*Expectation, 0, len(s.expectations)+len(loaded))
+	inserted := false
+
+	for _, expectation := range s.expectations {
+		if expectation.source == nil {
+			expectations = append(expectations, expectation)
+			continue
+		}
+
+		// The new set takes the place of the old one
+		if !inserted {
+			expectations = append(expectations, loaded...)
+			inserted = true
+		}
+	}
+
+	if !inserted {
+		expectations = append(expectations, loaded...)
+	}
+
+	s.expectations = expectations
+	s.mutex.Unlock()
+
+	for _, removed := range previous {
+		if err := s.store().Delete(removed.Uuid); err != nil {
+			log.Printf("ERROR: deleting stored requests of %s: %v", removed.Uuid, err)
+		}
+	}
+}
+
+// reloadExpectationsDir reloads the expectations directory, keeping the
+// previously loaded expectations if any file is invalid.
+func (s *Server) reloadExpectationsDir(dir string) error {
+	loaded, err := loadExpectationsDir(dir)
+	if err != nil {
+		return err
+	}
+
+	s.replaceFileExpectations(loaded)
+	return nil
+}
+
+// watchExpectationsDir polls dir for files being added, edited or removed
+// and reloads the expectations when they are, until stop is closed.
+func (s *Server) watchExpectationsDir(dir string, interval time.Duration, stop <-chan struct{}) {
+	last, _ := expectationsDirSnapshot(dir)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+
+		snapshot, err := expectationsDirSnapshot(dir)
+		if err != nil {
+			log.Printf("ERROR: watching %s: %v", dir, err)
+			continue
+		}
+
+		if snapshot == last {
+			continue
+		}
+		last = snapshot
+
+		if err := s.reloadExpectationsDir(dir); err != nil {
+			log.Printf("ERROR: reloading expectations, keeping the previous set: %v", err)
+			continue
+		}
+
+		log.Printf("Reloaded expectations from %s", dir)
+	}
+}
+
+// expectationsDirSnapshot summarises the name, size and modification time
+// of the expectation files in dir, so that changes can be spotted.
+func expectationsDirSnapshot(dir string) (string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	for _, file := range files {
+		if !file.IsDir() && filepath.Ext(file.Name()) == ".json" {
+			fmt.Fprintf(&buf, "%s %d %d\n", file.Name(), file.Size(), file.ModTime().UnixNano())
+		}
+	}
+
+	return buf.String(), nil
+}
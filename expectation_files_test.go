@@ -0,0 +1,280 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/satori/go.uuid"
+)
+
+func writeExpectationFile(t *testing.T, dir, name, contents string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestLoadExpectationsDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "everdeen-expectations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeExpectationFile(t, dir, "b.json", `{"expectations": [
+		{"request_criteria": [{"type": "path", "value": "/b"}], "respond_with": {"status": 201}}
+	]}`)
+	writeExpectationFile(t, dir, "a.json", `{"expectations": [
+		{"request_criteria": [{"type": "path", "value": "/a"}], "respond_with": {"status": 200}}
+	]}`)
+	writeExpectationFile(t, dir, "notes.txt", `not json`)
+
+	expectations, err := loadExpectationsDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(expectations) != 2 {
+		t.Fatalf("expected 2 expectations, got: %d", len(expectations))
+	}
+
+	if expectations[0].RequestCriteria[0].Value != "/a" || expectations[1].RequestCriteria[0].Value != "/b" {
+		t.Errorf("expected expectations to be loaded in file name order, got: %s, %s",
+			expectations[0].RequestCriteria[0].Value, expectations[1].RequestCriteria[0].Value)
+	}
+
+	if expectations[0].RequestCriteria[0].MatchType != MatchTypeExact {
+		t.Errorf("expected loaded expectations to be prepared, got match type: %q", expectations[0].RequestCriteria[0].MatchType)
+	}
+}
+
+func TestLoadExpectationsFileRejectsInvalidExpectations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "everdeen-expectations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	testCases := map[string]string{
+		"bad-json.json":  `{"expectations": [`,
+		"bad-regex.json": `{"expectations": [{"request_criteria": [{"type": "path", "match_type": "regex", "value": "("}]}]}`,
+	}
+
+	for name, contents := range testCases {
+		path := writeExpectationFile(t, dir, name, contents)
+
+		_, err := loadExpectationsFile(path)
+		if err == nil {
+			t.Errorf("%s: expected an error", name)
+			continue
+		}
+
+		if !strings.Contains(err.Error(), name) {
+			t.Errorf("%s: expected the error to name the file, got: %v", name, err)
+		}
+	}
+}
+
+func TestReloadExpectationsDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "everdeen-expectations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	server := &Server{}
+
+	writeExpectationFile(t, dir, "stubs.json", `{"expectations": [
+		{"request_criteria": [{"type": "path", "value": "/file-v1"}]}
+	]}`)
+
+	if err := server.reloadExpectationsDir(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	server.addExpectations([]*Expectation{
+		{RequestCriteria: Criteria{{Type: CriteriaTypePath, MatchType: MatchTypeExact, Value: "/api"}}},
+	})
+
+	paths := func() []string {
+		server.mutex.RLock()
+		defer server.mutex.RUnlock()
+
+		paths := []string{}
+		for _, expectation := range server.expectations {
+			paths = append(paths, expectation.RequestCriteria[0].Value)
+		}
+
+		return paths
+	}
+
+	before, _ := expectationsDirSnapshot(dir)
+
+	writeExpectationFile(t, dir, "stubs.json", `{"expectations": [
+		{"request_criteria": [{"type": "path", "value": "/file-v2"}]}
+	]}`)
+	writeExpectationFile(t, dir, "more.json", `{"expectations": [
+		{"request_criteria": [{"type": "path", "value": "/file-more"}]}
+	]}`)
+
+	after, _ := expectationsDirSnapshot(dir)
+	if before == after {
+		t.Error("expected the directory snapshot to change")
+	}
+
+	if err := server.reloadExpectationsDir(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := strings.Join(paths(), ","), "/file-more,/file-v2,/api"; got != want {
+		t.Errorf("expected expectations %s after reloading, got: %s", want, got)
+	}
+
+	writeExpectationFile(t, dir, "broken.json", `{"expectations": [`)
+
+	if err := server.reloadExpectationsDir(dir); err == nil {
+		t.Error("expected an error reloading an invalid file")
+	}
+
+	if got, want := strings.Join(paths(), ","), "/file-more,/file-v2,/api"; got != want {
+		t.Errorf("expected the previous expectations %s to be kept, got: %s", want, got)
+	}
+
+	os.Remove(filepath.Join(dir, "broken.json"))
+	os.Remove(filepath.Join(dir, "more.json"))
+	os.Remove(filepath.Join(dir, "stubs.json"))
+
+	if err := server.reloadExpectationsDir(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := strings.Join(paths(), ","), "/api"; got != want {
+		t.Errorf("expected only %s to remain, got: %s", want, got)
+	}
+}
+
+func TestReloadExpectationsDirKeepsUnchangedExpectations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "everdeen-expectations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	server := &Server{requestStore: NewMemoryRequestStore(0)}
+
+	writeExpectationFile(t, dir, "a.json", `{"expectations": [
+		{"request_criteria": [{"type": "path", "value": "/a1"}]},
+		{"request_criteria": [{"type": "path", "value": "/a2"}]}
+	]}`)
+	writeExpectationFile(t, dir, "b.json", `{"expectations": [
+		{"request_criteria": [{"type": "path", "value": "/b-v1"}]}
+	]}`)
+
+	if err := server.reloadExpectationsDir(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	type loaded struct {
+		Uuid    uuid.UUID
+		Matches int
+	}
+
+	snapshot := func() map[string]loaded {
+		server.mutex.RLock()
+		defer server.mutex.RUnlock()
+
+		found := map[string]loaded{}
+		for _, e := range server.expectations {
+			found[e.RequestCriteria[0].Value] = loaded{Uuid: e.Uuid, Matches: e.Matches}
+		}
+
+		return found
+	}
+
+	server.mutex.Lock()
+	for _, e := range server.expectations {
+		e.Matches = 2
+
+		req, _ := http.NewRequest("GET", "http://example.com"+e.RequestCriteria[0].Value, nil)
+		if err := saveRequest(server.store(), e.Uuid, req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	server.mutex.Unlock()
+
+	before := snapshot()
+
+	writeExpectationFile(t, dir, "b.json", `{"expectations": [
+		{"request_criteria": [{"type": "path", "value": "/b-v2"}]}
+	]}`)
+
+	if err := server.reloadExpectationsDir(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	after := snapshot()
+
+	for _, path := range []string{"/a1", "/a2"} {
+		if !uuid.Equal(after[path].Uuid, before[path].Uuid) || after[path].Matches != 2 {
+			t.Errorf("expected %s to keep its uuid and matches, got %+v, was %+v", path, after[path], before[path])
+		}
+
+		if found, _ := server.store().Where(after[path].Uuid); len(found) != 1 {
+			t.Errorf("expected the stored requests of %s to be kept, got: %d", path, len(found))
+		}
+	}
+
+	if _, ok := after["/b-v2"]; !ok || after["/b-v2"].Matches != 0 || uuid.Equal(after["/b-v2"].Uuid, before["/b-v1"].Uuid) {
+		t.Errorf("expected the changed expectation to be replaced, got %+v", after)
+	}
+
+	if found, _ := server.store().Where(before["/b-v1"].Uuid); len(found) != 0 {
+		t.Errorf("expected the stored requests of the replaced expectation to be deleted, got: %d", len(found))
+	}
+}
+
+func TestWatchExpectationsDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "everdeen-expectations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	server := &Server{}
+
+	stop := make(chan struct{})
+	defer close(stop)
+
+	go server.watchExpectationsDir(dir, 10*time.Millisecond, stop)
+
+	// Let the watch take its first snapshot of the empty directory
+	time.Sleep(20 * time.Millisecond)
+
+	writeExpectationFile(t, dir, "stubs.json", `{"expectations": [
+		{"request_criteria": [{"type": "path", "value": "/watched"}]}
+	]}`)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		server.mutex.RLock()
+		loaded := len(server.expectations)
+		server.mutex.RUnlock()
+
+		if loaded == 1 {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("expected the watch to load the new expectation file")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// collectExpired removes expired expectations along with their stored
+// requests.
+func (s *Server) collectExpired(now time.Time) {
+	s.mutex.Lock()
+
+	expectations := make([]*Expectation, 0, len(s.expectations))
+	removed := []*Expectation{}
+
+	for _, e := range s.expectations {
+		if e.expiredAt(now) {
+			removed = append(removed, e)
+		} else {
+			expectations = append(expectations, e)
+		}
+	}
+
+	s.expectations = expectations
+	s.mutex.Unlock()
+
+	// The file store deletes from disk, so don't hold up the proxy
+	for _, e := range removed {
+		if err := s.store().Delete(e.Uuid); err != nil {
+			log.Printf("ERROR: deleting stored requests of expired expectation %s: %v", e.Uuid, err)
+		}
+	}
+}
+
+// collectExpiredEvery periodically garbage collects expired expectations,
+// until then they are still listed with `"expired": true`.
+func (s *Server) collectExpiredEvery(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		s.collectExpired(now)
+	}
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+type Fault string
+
+const (
+	FaultNone             Fault = ""
+	FaultCloseConnection  Fault = "close_connection"
+	FaultResetConnection  Fault = "reset_connection"
+	FaultHangAfterHeaders Fault = "hang_after_headers"
+	FaultTruncatedBody    Fault = "truncated_body"
+	FaultMalformedStatus  Fault = "malformed_status"
+)
+
+// defaultFaultHangTimeout is how long a hang_after_headers fault keeps the
+// connection open for before giving up on the client.
+const defaultFaultHangTimeout = 5 * time.Minute
+
+var errTruncatedBody = errors.New("everdeen: truncated body fault")
+
+func (f Fault) Validate() error {
+	switch f {
+	case FaultNone, FaultCloseConnection, FaultResetConnection, FaultHangAfterHeaders, FaultTruncatedBody, FaultMalformedStatus:
+		return nil
+	}
+
+	return fmt.Errorf("unknown fault %q", f)
+}
+
+// clientConns keeps track of the connections proxied requests arrive on, as
+// goproxy only gives request handlers the request, so that faults can be
+// injected below the HTTP layer.
+type clientConns struct {
+	mutex sync.Mutex
+
+	// Plain HTTP requests currently being handled, by remote address
+	writers map[string]http.ResponseWriter
+
+	// Hijacked CONNECT tunnels, by remote address. goproxy copies the
+	// remote address of the CONNECT request onto the requests it reads
+	// from a MITM'd tunnel.
+	tunnels map[string]*tunnelConn
+}
+
+func (c *clientConns) addWriter(addr string, w http.ResponseWriter) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.writers == nil {
+		c.writers = map[string]http.ResponseWriter{}
+	}
+
+	c.writers[addr] = w
+}
+
+func (c *clientConns) removeWriter(addr string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	delete(c.writers, addr)
+}
+
+func (c *clientConns) addTunnel(addr string, conn *tunnelConn) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.tunnels == nil {
+		c.tunnels = map[string]*tunnelConn{}
+	}
+
+	c.tunnels[addr] = conn
+}
+
+func (c *clientConns) removeTunnel(addr string, conn *tunnelConn) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.tunnels[addr] == conn {
+		delete(c.tunnels, addr)
+	}
+}
+
+func (c *clientConns) find(addr string) (http.ResponseWriter, *tunnelConn) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.writers[addr], c.tunnels[addr]
+}
+
+// tunnelRecorder records the connection of a CONNECT request when goproxy
+// hijacks it.
+type tunnelRecorder struct {
+	http.ResponseWriter
+	conns   *clientConns
+	addr    string
+	session string
+}
+
+func (t *tunnelRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := t.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("everdeen: connection does not support hijacking")
+	}
+
+	conn, buf, err := hj.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tunnel := &tunnelConn{Conn: conn, conns: t.conns, addr: t.addr, session: t.session}
+	t.conns.addTunnel(t.addr, tunnel)
+
+	return tunnel, buf, nil
+}
+
+// hijackableWriter quietly drops what goproxy writes once a fault has
+// hijacked the connection from under it.
+type hijackableWriter struct {
+	http.ResponseWriter
+	hijacked bool
+}
+
+func (h *hijackableWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := h.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("everdeen: connection does not support hijacking")
+	}
+
+	conn, buf, err := hj.Hijack()
+	if err == nil {
+		h.hijacked = true
+	}
+
+	return conn, buf, err
+}
+
+func (h *hijackableWriter) WriteHeader(status int) {
+	if !h.hijacked {
+		h.ResponseWriter.WriteHeader(status)
+	}
+}
+
+func (h *hijackableWriter) Write(b []byte) (int, error) {
+	if h.hijacked {
+		return 0, http.ErrHijacked
+	}
+
+	return h.ResponseWriter.Write(b)
+}
+
+type tunnelConn struct {
+	net.Conn
+	conns *clientConns
+	addr  string
+
+	// The session named by the CONNECT request, which the requests
+	// read from the tunnel belong to
+	session string
+}
+
+func (t *tunnelConn) Close() error {
+	t.conns.removeTunnel(t.addr, t)
+	return t.Conn.Close()
+}
+
+// ProxyHandler wraps the goproxy server so that the connections requests
+// arrive on are available for fault injection, and the sessions of MITM'd
+// HTTPS requests can be found.
+func (s *Server) ProxyHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "CONNECT" {
+			w = &tunnelRecorder{ResponseWriter: w, conns: &s.conns, addr: r.RemoteAddr, session: s.directSession(r)}
+		} else {
+			w = &hijackableWriter{ResponseWriter: w}
+			s.conns.addWriter(r.RemoteAddr, w)
+			defer s.conns.removeWriter(r.RemoteAddr)
+		}
+
+		s.Proxy.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) injectFault(r *http.Request, fault Fault, rw RespondWith) (*http.Request, *http.Response) {
+	_, resp := proxyRespond(r, rw)
+	if resp.StatusCode == 0 {
+		resp.StatusCode = http.StatusOK
+	}
+
+	hangTimeout := s.faultHangTimeout
+	if hangTimeout == 0 {
+		hangTimeout = defaultFaultHangTimeout
+	}
+
+	w, tunnel := s.conns.find(r.RemoteAddr)
+
+	if tunnel != nil && r.URL.Scheme == "https" {
+		return r, tunnelFault(tunnel, fault, resp, hangTimeout)
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		return r, goproxy.NewResponse(r, goproxy.ContentTypeText, http.StatusBadGateway, "everdeen: unable to inject fault on this connection")
+	}
+
+	conn, buf, err := hj.Hijack()
+	if err != nil {
+		return r, goproxy.NewResponse(r, goproxy.ContentTypeText, http.StatusBadGateway, fmt.Sprintf("everdeen: %s", err))
+	}
+
+	if err := plainFault(conn, buf.Writer, fault, resp, hangTimeout); err != nil {
+		log.Printf("ERROR: injecting %s fault: %v", fault, err)
+	}
+
+	// The connection has been hijacked so goproxy's attempt to write this
+	// response goes nowhere.
+	return r, resp
+}
+
+// plainFault injects a fault by writing directly to the client connection
+// of a plain HTTP request.
+func plainFault(conn net.Conn, w *bufio.Writer, fault Fault, resp *http.Response, hangTimeout time.Duration) error {
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	switch fault {
+	case FaultCloseConnection:
+		return conn.Close()
+	case FaultResetConnection:
+		return resetConn(conn)
+	case FaultMalformedStatus:
+		io.WriteString(w, "HTTP/1.1 everdeen malformed status\r\n\r\n")
+	case FaultHangAfterHeaders:
+		writeResponseHead(w, resp, len(body))
+		if err := w.Flush(); err != nil {
+			conn.Close()
+			return err
+		}
+
+		conn.SetReadDeadline(time.Now().Add(hangTimeout))
+
+		go func() {
+			io.Copy(ioutil.Discard, conn)
+			conn.Close()
+		}()
+
+		return nil
+	case FaultTruncatedBody:
+		body = truncatedBody(body)
+		writeResponseHead(w, resp, len(body))
+		w.Write(body[:len(body)/2])
+	}
+
+	w.Flush()
+	return conn.Close()
+}
+
+// tunnelFault injects a fault into a MITM'd HTTPS tunnel. goproxy owns the
+// TLS connection so, other than for the connection level faults, it is
+// handed a response crafted to make it produce the fault.
+func tunnelFault(tunnel *tunnelConn, fault Fault, resp *http.Response, hangTimeout time.Duration) *http.Response {
+	switch fault {
+	case FaultCloseConnection:
+		tunnel.Close()
+	case FaultResetConnection:
+		resetConn(tunnel)
+	case FaultMalformedStatus:
+		resp.StatusCode = 0
+		resp.Status = "everdeen malformed status"
+	case FaultHangAfterHeaders:
+		resp.Body = &hangingBody{tunnel: tunnel, timeout: time.After(hangTimeout)}
+	case FaultTruncatedBody:
+		body, _ := ioutil.ReadAll(resp.Body)
+		body = truncatedBody(body)
+
+		resp.Body = ioutil.NopCloser(io.MultiReader(
+			strings.NewReader(string(body[:len(body)/2])),
+			&errorReader{errTruncatedBody},
+		))
+	}
+
+	return resp
+}
+
+func writeResponseHead(w io.Writer, resp *http.Response, contentLength int) {
+	fmt.Fprintf(w, "HTTP/1.1 %03d %s\r\n", resp.StatusCode, http.StatusText(resp.StatusCode))
+	resp.Header.Set("Content-Length", strconv.Itoa(contentLength))
+	resp.Header.Write(w)
+	io.WriteString(w, "\r\n")
+}
+
+// truncatedBody ensures there is a body to truncate.
+func truncatedBody(body []byte) []byte {
+	if len(body) < 2 {
+		return []byte("everdeen truncated body")
+	}
+
+	return body
+}
+
+// resetConn closes the connection with a TCP RST rather than a FIN.
+func resetConn(conn net.Conn) error {
+	raw := conn
+	if tunnel, ok := conn.(*tunnelConn); ok {
+		raw = tunnel.Conn
+	}
+
+	if tcp, ok := raw.(*net.TCPConn); ok {
+		tcp.SetLinger(0)
+	}
+
+	return conn.Close()
+}
+
+type hangingBody struct {
+	tunnel  *tunnelConn
+	timeout <-chan time.Time
+}
+
+func (h *hangingBody) Read(p []byte) (int, error) {
+	<-h.timeout
+	h.tunnel.Close()
+	return 0, io.ErrUnexpectedEOF
+}
+
+func (h *hangingBody) Close() error {
+	return nil
+}
+
+type errorReader struct {
+	err error
+}
+
+func (e *errorReader) Read(p []byte) (int, error) {
+	return 0, e.err
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/satori/go.uuid"
+)
+
+// The types below are the parts of HTTP Archive 1.2 everdeen fills in,
+// see http://www.softwareishard.com/blog/har-12-spec/
+
+type HAR struct {
+	Log HARLog `json:"log"`
+}
+
+type HARLog struct {
+	Version string     `json:"version"`
+	Creator HARCreator `json:"creator"`
+	Entries []HAREntry `json:"entries"`
+}
+
+type HARCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type HAREntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         HARRequest  `json:"request"`
+	Response        HARResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         HARTimings  `json:"timings"`
+	Comment         string      `json:"comment,omitempty"`
+}
+
+type HARRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARNameValue `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	QueryString []HARNameValue `json:"queryString"`
+	PostData    *HARPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type HARResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARNameValue `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	Content     HARContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type HARNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type HARPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type HARContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+type HARTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// exportHAR exports the journal, covering every request the proxy has
+// responded to, as a HAR. It can be limited to the requests matching an
+// expectation, or the requests of a session.
+func (s *Server) exportHAR(w http.ResponseWriter, r *http.Request) {
+	session, ok := s.sessionParam(w, r)
+	if !ok {
+		return
+	}
+
+	expUuid := uuid.Nil
+
+	if v := r.URL.Query().Get("expectation_uuid"); v != "" {
+		var err error
+		if expUuid, err = uuid.FromString(v); err != nil {
+			http.Error(w, fmt.Sprintf("everdeen: invalid expectation_uuid %q", v), http.StatusBadRequest)
+			return
+		}
+	}
+
+	har := HAR{Log: HARLog{
+		Version: "1.2",
+		Creator: HARCreator{Name: "everdeen", Version: Version},
+		Entries: []HAREntry{},
+	}}
+
+	for _, entry := range s.journal.SessionEntries(session) {
+		if uuid.Equal(expUuid, uuid.Nil) || uuid.Equal(entry.ExpectationUuid, expUuid) {
+			har.Log.Entries = append(har.Log.Entries, newHAREntry(entry))
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="everdeen.har"`)
+
+	if err := json.NewEncoder(w).Encode(har); err != nil {
+		http.Error(w, fmt.Sprintf("everdeen: %s", err), http.StatusInternalServerError)
+		log.Printf("ERROR: %v", err)
+	}
+}
+
+func newHAREntry(journaled JournalEntry) HAREntry {
+	request := journaled.Request
+	body, _ := base64.StdEncoding.DecodeString(request.BodyBase64)
+
+	// The time to respond includes any delay, so is all spent waiting
+	entry := HAREntry{
+		StartedDateTime: request.Time.Format(time.RFC3339Nano),
+		Time:            request.DurationMs,
+		Request: HARRequest{
+			Method:      request.Method,
+			URL:         request.URL,
+			HTTPVersion: "HTTP/1.1",
+			Cookies:     []HARNameValue{},
+			Headers:     harHeaders(request.Headers),
+			QueryString: []HARNameValue{},
+			HeadersSize: -1,
+			BodySize:    len(body),
+		},
+		Response: HARResponse{
+			Cookies:     []HARNameValue{},
+			Headers:     []HARNameValue{},
+			HTTPVersion: "HTTP/1.1",
+			HeadersSize: -1,
+			BodySize:    -1,
+		},
+		Timings: HARTimings{Wait: request.DurationMs},
+	}
+
+	comments := []string{}
+	if !uuid.Equal(request.ExpectationUuid, uuid.Nil) {
+		comments = append(comments, "expectation "+request.ExpectationUuid.String())
+	}
+
+	if journaled.Fault != FaultNone {
+		comments = append(comments, "fault "+string(journaled.Fault))
+	}
+
+	entry.Comment = strings.Join(comments, ", ")
+
+	if u, err := url.Parse(request.URL); err == nil {
+		for key, values := range u.Query() {
+			for _, value := range values {
+				entry.Request.QueryString = append(entry.Request.QueryString, HARNameValue{key, value})
+			}
+		}
+
+		sort.Stable(harNameValues(entry.Request.QueryString))
+	}
+
+	if len(body) > 0 {
+		entry.Request.PostData = &HARPostData{
+			MimeType: firstHeader(request.Headers, "Content-Type"),
+			Text:     string(body),
+		}
+	}
+
+	// Requests answered with a fault, whose upstream server couldn't be
+	// reached or that are still being responded to have no response
+	if request.Response == nil {
+		return entry
+	}
+
+	resp := request.Response
+	body, _ = base64.StdEncoding.DecodeString(resp.BodyBase64)
+
+	entry.Response.Status = resp.Status
+	entry.Response.StatusText = http.StatusText(resp.Status)
+	entry.Response.Headers = harHeaders(resp.Headers)
+	entry.Response.BodySize = len(body)
+	entry.Response.Content = HARContent{
+		Size:     len(body),
+		MimeType: firstHeader(resp.Headers, "Content-Type"),
+	}
+
+	if utf8.Valid(body) {
+		entry.Response.Content.Text = string(body)
+	} else {
+		entry.Response.Content.Text = resp.BodyBase64
+		entry.Response.Content.Encoding = "base64"
+	}
+
+	return entry
+}
+
+func harHeaders(headers map[string][]string) []HARNameValue {
+	nameValues := []HARNameValue{}
+	for key, values := range headers {
+		for _, value := range values {
+			nameValues = append(nameValues, HARNameValue{key, value})
+		}
+	}
+
+	sort.Stable(harNameValues(nameValues))
+
+	return nameValues
+}
+
+func firstHeader(headers map[string][]string, key string) string {
+	for k, values := range headers {
+		if strings.EqualFold(k, key) && len(values) > 0 {
+			return values[0]
+		}
+	}
+
+	return ""
+}
+
+type harNameValues []HARNameValue
+
+func (h harNameValues) Len() int           { return len(h) }
+func (h harNameValues) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h harNameValues) Less(i, j int) bool { return h[i].Name < h[j].Name }
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/http"
+	"sync"
+)
+
+// JournalEntry is a request received by the proxy, in the order it arrived.
+type JournalEntry struct {
+	Sequence int `json:"sequence"`
+
+	// The ExpectationUuid of the request is nil if no expectation matched
+	Request
+
+	// The fault injected instead of a response, if any
+	Fault Fault `json:"fault,omitempty"`
+
+	// The closest expectations to an unmatched request
+	NearMisses []NearMiss `json:"near_misses,omitempty"`
+}
+
+// Journal keeps the most recent requests received by the proxy, whether or
+// not they matched an expectation, for verifying against.
+type Journal struct {
+	entries  []JournalEntry
+	sequence int
+	mutex    sync.RWMutex
+
+	// The most entries kept, the oldest are dropped first. Zero keeps
+	// every entry.
+	limit int
+
+	// Roughly the most bytes of requests kept, the oldest are dropped
+	// first. Zero doesn't bound the size.
+	maxBytes int
+	size     int
+}
+
+func (j *Journal) SetLimit(limit int) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	j.limit = limit
+	j.trim()
+}
+
+func (j *Journal) SetMaxBytes(maxBytes int) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	j.maxBytes = maxBytes
+	j.trim()
+}
+
+// Add numbers and adds the entry to the journal.
+func (j *Journal) Add(entry JournalEntry) JournalEntry {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	j.sequence += 1
+
+	entry.Sequence = j.sequence
+
+	j.entries = append(j.entries, entry)
+	j.size += requestSize(entry.Request)
+	j.trim()
+
+	return entry
+}
+
+// Responded records the response to the request of an entry, once it's
+// known, if the entry is still in the journal.
+func (j *Journal) Responded(sequence int, request Request) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	for i := len(j.entries) - 1; i >= 0 && j.entries[i].Sequence >= sequence; i-- {
+		if j.entries[i].Sequence != sequence {
+			continue
+		}
+
+		entry := &j.entries[i]
+		j.size -= requestSize(entry.Request)
+		entry.Response, entry.DurationMs, entry.UpstreamLatencyMs = request.Response, request.DurationMs, request.UpstreamLatencyMs
+		j.size += requestSize(entry.Request)
+
+		j.trim()
+		return
+	}
+}
+
+// Entries returns a copy of the journal, oldest first.
+func (j *Journal) Entries() []JournalEntry {
+	j.mutex.RLock()
+	defer j.mutex.RUnlock()
+
+	return append([]JournalEntry{}, j.entries...)
+}
+
+// EntriesSince returns the entries after a sequence number, oldest first.
+func (j *Journal) EntriesSince(sequence int) []JournalEntry {
+	j.mutex.RLock()
+	defer j.mutex.RUnlock()
+
+	i := len(j.entries)
+	for i > 0 && j.entries[i-1].Sequence > sequence {
+		i -= 1
+	}
+
+	return append([]JournalEntry{}, j.entries[i:]...)
+}
+
+// SessionEntries returns the entries of a session, or every entry when the
+// session is empty.
+func (j *Journal) SessionEntries(session string) []JournalEntry {
+	entries := j.Entries()
+	if session == "" {
+		return entries
+	}
+
+	found := []JournalEntry{}
+	for _, entry := range entries {
+		if entry.Session == session {
+			found = append(found, entry)
+		}
+	}
+
+	return found
+}
+
+// Remove drops the entries for which remove returns true.
+func (j *Journal) Remove(remove func(JournalEntry) bool) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	entries := []JournalEntry{}
+	for _, entry := range j.entries {
+		if remove(entry) {
+			j.size -= requestSize(entry.Request)
+		} else {
+			entries = append(entries, entry)
+		}
+	}
+
+	j.entries = entries
+}
+
+func (j *Journal) Reset() {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	j.entries = nil
+	j.size = 0
+}
+
+func (j *Journal) trim() {
+	drop := 0
+	if j.limit > 0 && len(j.entries) > j.limit {
+		drop = len(j.entries) - j.limit
+	}
+
+	for _, entry := range j.entries[:drop] {
+		j.size -= requestSize(entry.Request)
+	}
+
+	for j.maxBytes > 0 && j.size > j.maxBytes && drop < len(j.entries) {
+		j.size -= requestSize(j.entries[drop].Request)
+		drop += 1
+	}
+
+	if drop == 0 {
+		return
+	}
+
+	// Rather than copying the journal on every Add, the dropped entries are
+	// cleared so their requests can be collected and sliced off the front.
+	// The next append to outgrow the array copies only the entries left.
+	for i := range j.entries[:drop] {
+		j.entries[i] = JournalEntry{}
+	}
+
+	j.entries = j.entries[drop:]
+}
+
+// httpRequest rebuilds the request so it can be matched against criteria.
+func (r Request) httpRequest() (*http.Request, error) {
+	body, err := base64.StdEncoding.DecodeString(r.BodyBase64)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(r.Method, r.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	for key, values := range r.Headers {
+		req.Header[key] = values
+	}
+
+	return req, nil
+}
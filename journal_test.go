@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestJournal(t *testing.T) {
+	journal := Journal{}
+	journal.SetLimit(2)
+
+	for _, path := range []string{"/a", "/b", "/c"} {
+		req, err := http.NewRequest("POST", "http://example.com"+path, strings.NewReader("Hello World"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		request, err := newStoredRequest(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		journal.Add(JournalEntry{Request: request})
+	}
+
+	entries := journal.Entries()
+	if len(entries) != 2 {
+		t.Fatalf("expected the journal to be limited to 2 entries, got: %d", len(entries))
+	}
+
+	if entries[0].Sequence != 2 || entries[0].URL != "http://example.com/b" || entries[1].Sequence != 3 {
+		t.Errorf("expected the oldest entry to be dropped, got: %+v", entries)
+	}
+
+	if since := journal.EntriesSince(2); len(since) != 1 || since[0].Sequence != 3 {
+		t.Errorf("expected only the entry after sequence 2, got: %+v", since)
+	}
+
+	req, err := entries[1].httpRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if match, _ := bodyIsExactly(req, "Hello World"); !match {
+		t.Error("expected the rebuilt request to have the journaled body")
+	}
+
+	responded := entries[1].Request
+	responded.responded(&Response{Status: http.StatusCreated})
+	journal.Responded(entries[1].Sequence, responded)
+	journal.Responded(1, responded)
+
+	entries = journal.Entries()
+	if entries[0].Response != nil || entries[1].Response == nil || entries[1].Response.Status != http.StatusCreated || entries[1].DurationMs <= 0 {
+		t.Errorf("expected only the responded entry to have a response and duration, got: %+v", entries)
+	}
+
+	journal.Reset()
+
+	if entries := journal.Entries(); len(entries) != 0 {
+		t.Errorf("expected the journal to be empty after a reset, got: %d", len(entries))
+	}
+}
+
+func TestJournalMaxBytes(t *testing.T) {
+	journal := Journal{}
+
+	for _, path := range []string{"/a", "/b", "/c"} {
+		req, err := http.NewRequest("POST", "http://example.com"+path, strings.NewReader(strings.Repeat("x", 1000)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		request, err := newStoredRequest(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		journal.Add(JournalEntry{Request: request})
+	}
+
+	journal.SetMaxBytes(3000)
+
+	entries := journal.Entries()
+	if len(entries) != 2 || entries[0].URL != "http://example.com/b" {
+		t.Fatalf("expected the oldest entry to be dropped to fit 3000 bytes, got: %d entries", len(entries))
+	}
+
+	journal.Remove(func(entry JournalEntry) bool { return entry.URL == "http://example.com/b" })
+
+	if journal.size != requestSize(entries[1].Request) {
+		t.Errorf("expected the size to only count the remaining entry, got: %d", journal.size)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// decodeJSON decodes a request body preserving the literal representation
+// of numbers, so that a criterion value of "1.50" matches the body `1.50`.
+func decodeJSON(b []byte) (interface{}, error) {
+	var doc interface{}
+
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, err
+	}
+
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, fmt.Errorf("unexpected data after the JSON document")
+	}
+
+	return doc, nil
+}
+
+// jsonNodeString returns the value criteria are compared against for a
+// selected node: strings are used as is, everything else as encoded JSON.
+func jsonNodeString(node interface{}) string {
+	if s, ok := node.(string); ok {
+		return s
+	}
+
+	b, err := json.Marshal(node)
+	if err != nil {
+		return ""
+	}
+
+	return string(b)
+}
+
+// jsonEqual reports whether two decoded JSON documents are structurally
+// equal, numbers are compared by value so `1` and `1.0` are equal.
+func jsonEqual(expected, actual interface{}) bool {
+	switch e := expected.(type) {
+	case map[string]interface{}:
+		a, ok := actual.(map[string]interface{})
+		if !ok || len(a) != len(e) {
+			return false
+		}
+
+		for key, value := range e {
+			if av, ok := a[key]; !ok || !jsonEqual(value, av) {
+				return false
+			}
+		}
+
+		return true
+	case []interface{}:
+		a, ok := actual.([]interface{})
+		if !ok || len(a) != len(e) {
+			return false
+		}
+
+		for i := range e {
+			if !jsonEqual(e[i], a[i]) {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	return jsonScalarEqual(expected, actual)
+}
+
+// jsonContains reports whether expected is a subset of actual: every member
+// of an expected object must be contained by the same member of the actual
+// object, and every element of an expected array must be contained by some
+// element of the actual array (in any order).
+func jsonContains(expected, actual interface{}) bool {
+	switch e := expected.(type) {
+	case map[string]interface{}:
+		a, ok := actual.(map[string]interface{})
+		if !ok {
+			return false
+		}
+
+		for key, value := range e {
+			if av, ok := a[key]; !ok || !jsonContains(value, av) {
+				return false
+			}
+		}
+
+		return true
+	case []interface{}:
+		a, ok := actual.([]interface{})
+		if !ok {
+			return false
+		}
+
+		for _, value := range e {
+			found := false
+
+			for _, av := range a {
+				if jsonContains(value, av) {
+					found = true
+					break
+				}
+			}
+
+			if !found {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	return jsonScalarEqual(expected, actual)
+}
+
+func jsonScalarEqual(expected, actual interface{}) bool {
+	if en, ok := expected.(json.Number); ok {
+		an, ok := actual.(json.Number)
+		if !ok {
+			return false
+		}
+
+		ef, eerr := en.Float64()
+		af, aerr := an.Float64()
+		if eerr != nil || aerr != nil {
+			return en == an
+		}
+
+		return ef == af
+	}
+
+	return expected == actual
+}
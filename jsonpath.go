@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// jsonPath is a compiled JSONPath expression, it supports the subset of the
+// syntax that is useful for picking values out of request bodies:
+//
+//	$.store.book[0].title
+//	$['store']['book'][*].author
+//	$..author
+//	$.store.*
+type jsonPath []jsonPathStep
+
+type jsonPathStep struct {
+	recursive bool
+	wildcard  bool
+	isIndex   bool
+	key       string
+	index     int
+}
+
+func compileJSONPath(expr string) (jsonPath, error) {
+	expr = strings.TrimSpace(expr)
+
+	if !strings.HasPrefix(expr, "$") {
+		return nil, fmt.Errorf("json path %q must start with $", expr)
+	}
+
+	path := jsonPath{}
+	rest := expr[1:]
+
+	for len(rest) > 0 {
+		step := jsonPathStep{}
+
+		switch {
+		case strings.HasPrefix(rest, ".."):
+			step.recursive = true
+			rest = rest[2:]
+		case rest[0] == '.':
+			rest = rest[1:]
+		case rest[0] == '[':
+		default:
+			return nil, fmt.Errorf("invalid json path %q: unexpected %q", expr, rest[0])
+		}
+
+		if strings.HasPrefix(rest, "[") {
+			var err error
+			step, rest, err = parseJSONPathBracket(step, rest)
+			if err != nil {
+				return nil, fmt.Errorf("invalid json path %q: %s", expr, err)
+			}
+
+			path = append(path, step)
+			continue
+		}
+
+		end := strings.IndexAny(rest, ".[")
+		if end == -1 {
+			end = len(rest)
+		}
+
+		name := rest[:end]
+		rest = rest[end:]
+
+		if name == "" {
+			return nil, fmt.Errorf("invalid json path %q: empty member name", expr)
+		}
+
+		if name == "*" {
+			step.wildcard = true
+		} else {
+			step.key = name
+		}
+
+		path = append(path, step)
+	}
+
+	return path, nil
+}
+
+// parseJSONPathBracket parses a `[...]` segment from the start of rest,
+// returning the populated step and the remaining expression.
+func parseJSONPathBracket(step jsonPathStep, rest string) (jsonPathStep, string, error) {
+	end := strings.Index(rest, "]")
+	if end == -1 {
+		return step, rest, fmt.Errorf("unterminated [")
+	}
+
+	inner := strings.TrimSpace(rest[1:end])
+	rest = rest[end+1:]
+
+	switch {
+	case inner == "*":
+		step.wildcard = true
+	case len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0]:
+		step.key = inner[1 : len(inner)-1]
+	default:
+		index, err := strconv.Atoi(inner)
+		if err != nil {
+			return step, rest, fmt.Errorf("invalid index %q", inner)
+		}
+
+		step.isIndex = true
+		step.index = index
+	}
+
+	return step, rest, nil
+}
+
+// Select returns every node in doc selected by the path.
+func (p jsonPath) Select(doc interface{}) []interface{} {
+	nodes := []interface{}{doc}
+
+	for _, step := range p {
+		next := []interface{}{}
+
+		for _, node := range nodes {
+			if step.recursive {
+				for _, descendant := range jsonDescendants(node) {
+					next = append(next, step.apply(descendant)...)
+				}
+			} else {
+				next = append(next, step.apply(node)...)
+			}
+		}
+
+		nodes = next
+	}
+
+	return nodes
+}
+
+func (s jsonPathStep) apply(node interface{}) []interface{} {
+	switch n := node.(type) {
+	case map[string]interface{}:
+		if s.wildcard {
+			values := []interface{}{}
+			for _, key := range sortedKeys(n) {
+				values = append(values, n[key])
+			}
+			return values
+		}
+
+		if value, ok := n[s.key]; ok && !s.isIndex {
+			return []interface{}{value}
+		}
+	case []interface{}:
+		if s.wildcard {
+			return n
+		}
+
+		if s.isIndex {
+			index := s.index
+			if index < 0 {
+				index += len(n)
+			}
+
+			if index >= 0 && index < len(n) {
+				return []interface{}{n[index]}
+			}
+		}
+	}
+
+	return nil
+}
+
+// jsonDescendants returns node followed by all of its descendants, in
+// document order (object members are visited in key order).
+func jsonDescendants(node interface{}) []interface{} {
+	nodes := []interface{}{node}
+
+	switch n := node.(type) {
+	case map[string]interface{}:
+		for _, key := range sortedKeys(n) {
+			nodes = append(nodes, jsonDescendants(n[key])...)
+		}
+	case []interface{}:
+		for _, value := range n {
+			nodes = append(nodes, jsonDescendants(value)...)
+		}
+	}
+
+	return nodes
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
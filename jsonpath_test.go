@@ -0,0 +1,63 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestJSONPathSelect(t *testing.T) {
+	doc, err := decodeJSON([]byte(`{
+		"store": {
+			"book": [
+				{"title": "Sayings of the Century", "author": "Nigel Rees", "price": 8.95},
+				{"title": "Sword of Honour", "author": "Evelyn Waugh", "price": 12.99}
+			],
+			"bicycle": {"color": "red", "price": 19.95}
+		},
+		"owner.name": "Katniss"
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		path     string
+		expected []string
+	}{
+		{"$.store.book[0].title", []string{"Sayings of the Century"}},
+		{"$.store.book[-1].author", []string{"Evelyn Waugh"}},
+		{"$['store']['bicycle'].color", []string{"red"}},
+		{"$.store.book[*].author", []string{"Nigel Rees", "Evelyn Waugh"}},
+		{"$.store.bicycle.*", []string{"red", "19.95"}},
+		{"$..price", []string{"19.95", "8.95", "12.99"}},
+		{"$..book[1].title", []string{"Sword of Honour"}},
+		{`$["owner.name"]`, []string{"Katniss"}},
+		{"$.store.book[5]", []string{}},
+		{"$.missing.key", []string{}},
+	}
+
+	for _, tc := range testCases {
+		path, err := compileJSONPath(tc.path)
+		if err != nil {
+			t.Errorf("unexpected error compiling %s: %v", tc.path, err)
+			continue
+		}
+
+		got := []string{}
+		for _, node := range path.Select(doc) {
+			got = append(got, jsonNodeString(node))
+		}
+
+		if !reflect.DeepEqual(tc.expected, got) {
+			t.Errorf("unexpected nodes selected by %s, expected: %v, got: %v", tc.path, tc.expected, got)
+		}
+	}
+}
+
+func TestJSONPathCompileErrors(t *testing.T) {
+	for _, expr := range []string{"", "store.book", "$.store[", "$.store[abc]", "$.store..", "$.store.book.[0]x"} {
+		if _, err := compileJSONPath(expr); err == nil {
+			t.Errorf("expected an error compiling %q but got none", expr)
+		}
+	}
+}
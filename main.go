@@ -5,15 +5,16 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"math"
 	"net/http"
 	"os"
 	"path"
 	"regexp"
 	"time"
 
+	"github.com/elazarl/goproxy"
 	"github.com/geckoboard/everdeen/certs"
 	"github.com/satori/go.uuid"
-	"github.com/elazarl/goproxy"
 )
 
 // Injected by the Makefile
@@ -29,7 +30,19 @@ var (
 	caKeyPath        = flag.String("ca-key-path", "", "Path to CA private key file")
 	passthroughMode  = flag.Bool("passthrough-mode", false, "Start up everdeen and default all proxied traffic to passthrough")
 	requestBaseStore = flag.String("request-base-store", path.Join(os.TempDir(), "everdeenStore"), "Base store for matching requests")
+	requestStoreType = flag.String("request-store", "file", "Where matching requests are stored, file (under -request-base-store) or memory")
+	requestStoreMax  = flag.Int("request-store-max-bytes", 64<<20, "Roughly how much memory the memory request store may use before dropping the oldest requests, 0 is unbounded")
 	generateCA       = flag.Bool("generate-ca-cert", false, "Generate CA certificate and private key for MITM")
+	record           = flag.Bool("record", false, "Record pass through traffic as expectations, exported from GET /recordings")
+	expectationsFile = flag.String("expectations-file", "", "Path to a JSON file of expectations to load at startup")
+	expectationsDir  = flag.String("expectations-dir", "", "Path to a directory of JSON expectation files to load at startup")
+	journalSize      = flag.Int("journal-size", 10000, "How many of the most recent requests (and unmatched requests) to keep, 0 keeps every request")
+	journalMaxBytes  = flag.Int("journal-max-bytes", 64<<20, "Roughly how much memory the most recent requests (and unmatched requests) may use before dropping the oldest, 0 is unbounded")
+	nearMisses       = flag.Bool("near-misses-in-response", false, "Describe the closest expectations in the body of the 404 for unmatched requests")
+	sessionHeader    = flag.String("session-header", defaultSessionHeader, "Header naming the session a proxied request belongs to, as well as the proxy credentials username")
+	expiredInterval  = flag.Duration("expired-gc-interval", time.Minute, "How often expired expectations are garbage collected, 0 disables collection")
+	matchOrder       = flag.String("match-order", "oldest", "Which of several matching expectations of equal priority is used, oldest or newest")
+	reloadInterval   = flag.Duration("expectations-reload-interval", time.Second, "How often to check -expectations-dir for changes, 0 disables reloading")
 )
 
 func main() {
@@ -53,6 +66,13 @@ func startProxy() {
 	fmt.Printf("Proxy Address: %s\n", *proxyAddr)
 	fmt.Printf("Control Address: %s\n", *controlAddr)
 	fmt.Printf("Passthrough all traffic: %t\n", *passthroughMode)
+	fmt.Printf("Recording pass through traffic: %t\n", *record)
+	fmt.Printf("Match order: %s\n", *matchOrder)
+	fmt.Printf("Request store: %s\n", *requestStoreType)
+
+	if *matchOrder != "oldest" && *matchOrder != "newest" {
+		log.Fatalf("unknown match order %q, expected oldest or newest", *matchOrder)
+	}
 
 	if *caCertPath != "" && *caKeyPath != "" {
 		tlsc, err := tls.LoadX509KeyPair(*caCertPath, *caKeyPath)
@@ -68,34 +88,87 @@ func startProxy() {
 
 	proxy := goproxy.NewProxyHttpServer()
 
+	var requestStore RequestStore
+
+	switch *requestStoreType {
+	case "file":
+		requestStore = &FileRequestStore{}
+	case "memory":
+		requestStore = NewMemoryRequestStore(*requestStoreMax)
+	default:
+		log.Fatalf("unknown request store %q, expected file or memory", *requestStoreType)
+	}
+
 	server := &Server{
 		Proxy:        proxy,
 		expectations: []*Expectation{},
+		requestStore: requestStore,
+		newestFirst:  *matchOrder == "newest",
+
+		nearMissesInResponse: *nearMisses,
+		sessionHeader:        *sessionHeader,
 	}
 
 	if *passthroughMode {
 		exp := Expectation{
-				Uuid: uuid.NewV4(),
-				PassThrough: true,
-				RequestCriteria: Criteria{
-					{
-						Type:  CriteriaTypeHost,
-						regexp: regexp.MustCompile(".*"),
-						MatchType: MatchTypeRegex,
-					},
+			Uuid:        uuid.NewV4(),
+			PassThrough: true,
+			// Any other expectation takes precedence over the catch-all
+			Priority: math.MinInt32,
+			RequestCriteria: Criteria{
+				{
+					Type:      CriteriaTypeHost,
+					regexp:    regexp.MustCompile(".*"),
+					MatchType: MatchTypeRegex,
 				},
-			}
+			},
+		}
 
 		server.expectations = append(server.expectations, &exp)
 	}
 
+	if *expectationsFile != "" {
+		expectations, err := loadExpectationsFile(*expectationsFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		server.addExpectations(expectations)
+		fmt.Printf("Loaded %d expectations from %s\n", len(expectations), *expectationsFile)
+	}
+
+	if *expectationsDir != "" {
+		expectations, err := loadExpectationsDir(*expectationsDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		server.replaceFileExpectations(expectations)
+		fmt.Printf("Loaded %d expectations from %s\n", len(expectations), *expectationsDir)
+
+		if *reloadInterval > 0 {
+			go server.watchExpectationsDir(*expectationsDir, *reloadInterval, nil)
+		}
+	}
+
+	if *expiredInterval > 0 {
+		go server.collectExpiredEvery(*expiredInterval)
+	}
+
+	server.recorder.SetEnabled(*record)
+	server.journal.SetLimit(*journalSize)
+	server.unmatched.SetLimit(*journalSize)
+	server.journal.SetMaxBytes(*journalMaxBytes)
+	server.unmatched.SetMaxBytes(*journalMaxBytes)
+
 	http.Handle("/", server)
 	go http.ListenAndServe(*controlAddr, nil)
 
 	proxy.Verbose = true
 	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
 	proxy.OnRequest().DoFunc(server.handleProxyRequest)
-	log.Fatal(http.ListenAndServe(*proxyAddr, proxy))
+	proxy.OnResponse().DoFunc(server.handleProxyResponse)
+	log.Fatal(http.ListenAndServe(*proxyAddr, server.ProxyHandler()))
 }
 
 func generateCACert() {
@@ -3,7 +3,10 @@ package main
 import (
 	"bytes"
 	"io/ioutil"
+	"mime"
+	"mime/multipart"
 	"net/http"
+	"net/url"
 	"reflect"
 	"regexp"
 	"sort"
@@ -26,12 +29,10 @@ func headerIsExactly(r *http.Request, key, value string) (bool, error) {
 }
 
 func bodyIsExactly(r *http.Request, body string) (bool, error) {
-	defer r.Body.Close()
-	bodyBytes, err := ioutil.ReadAll(r.Body)
+	bodyBytes, err := readBody(r)
 	if err != nil {
 		return false, err
 	}
-	r.Body = ioutil.NopCloser(bytes.NewReader(bodyBytes))
 	return string(bodyBytes) == body, nil
 }
 
@@ -71,11 +72,267 @@ func queryParamMatches(r *http.Request, key string, re *regexp.Regexp) (bool, er
 }
 
 func bodyMatches(r *http.Request, re *regexp.Regexp) (bool, error) {
+	bodyBytes, err := readBody(r)
+	if err != nil {
+		return false, err
+	}
+	return re.MatchString(string(bodyBytes)), nil
+}
+
+func bodyIsJSONEqual(r *http.Request, expected interface{}) (bool, error) {
+	doc, ok, err := decodeBodyJSON(r)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	return jsonEqual(expected, doc), nil
+}
+
+func bodyContainsJSON(r *http.Request, expected interface{}) (bool, error) {
+	doc, ok, err := decodeBodyJSON(r)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	return jsonContains(expected, doc), nil
+}
+
+func jsonPathIsExactly(r *http.Request, path jsonPath, value string) (bool, error) {
+	nodes, err := selectJSONPath(r, path)
+	if err != nil {
+		return false, err
+	}
+
+	for _, node := range nodes {
+		if jsonNodeString(node) == value {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func jsonPathIsAllOf(r *http.Request, path jsonPath, values []string) (bool, error) {
+	nodes, err := selectJSONPath(r, path)
+	if err != nil || len(nodes) == 0 {
+		return false, err
+	}
+
+	expected := sort.StringSlice(append([]string{}, values...))
+	expected.Sort()
+
+	got := sort.StringSlice{}
+	for _, node := range nodes {
+		got = append(got, jsonNodeString(node))
+	}
+	got.Sort()
+
+	return reflect.DeepEqual(expected, got), nil
+}
+
+func jsonPathMatches(r *http.Request, path jsonPath, re *regexp.Regexp) (bool, error) {
+	nodes, err := selectJSONPath(r, path)
+	if err != nil {
+		return false, err
+	}
+
+	for _, node := range nodes {
+		if re.MatchString(jsonNodeString(node)) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func jsonPathIsJSONEqual(r *http.Request, path jsonPath, expected interface{}) (bool, error) {
+	nodes, err := selectJSONPath(r, path)
+	if err != nil {
+		return false, err
+	}
+
+	for _, node := range nodes {
+		if jsonEqual(expected, node) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func jsonPathContainsJSON(r *http.Request, path jsonPath, expected interface{}) (bool, error) {
+	nodes, err := selectJSONPath(r, path)
+	if err != nil {
+		return false, err
+	}
+
+	for _, node := range nodes {
+		if jsonContains(expected, node) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// selectJSONPath returns the nodes selected by path from the request body,
+// a body that isn't valid JSON selects nothing.
+func selectJSONPath(r *http.Request, path jsonPath) ([]interface{}, error) {
+	doc, ok, err := decodeBodyJSON(r)
+	if err != nil || !ok {
+		return nil, err
+	}
+
+	return path.Select(doc), nil
+}
+
+// decodeBodyJSON decodes the request body as JSON, ok is false when the
+// body isn't valid JSON.
+func decodeBodyJSON(r *http.Request) (doc interface{}, ok bool, err error) {
+	bodyBytes, err := readBody(r)
+	if err != nil {
+		return nil, false, err
+	}
+
+	doc, err = decodeJSON(bodyBytes)
+	if err != nil {
+		return nil, false, nil
+	}
+
+	return doc, true, nil
+}
+
+func formFieldIsExactly(r *http.Request, key, value string) (bool, error) {
+	form, err := readForm(r)
+	if err != nil {
+		return false, err
+	}
+
+	return len(form.Value[key]) > 0 && form.Value[key][0] == value, nil
+}
+
+func formFieldIsAllOf(r *http.Request, key string, values []string) (bool, error) {
+	form, err := readForm(r)
+	if err != nil {
+		return false, err
+	}
+
+	formValues, ok := form.Value[key]
+	if !ok {
+		return false, nil
+	}
+
+	expected := sort.StringSlice(append([]string{}, values...))
+	expected.Sort()
+
+	got := sort.StringSlice(append([]string{}, formValues...))
+	got.Sort()
+
+	return reflect.DeepEqual(expected, got), nil
+}
+
+func formFieldMatches(r *http.Request, key string, re *regexp.Regexp) (bool, error) {
+	form, err := readForm(r)
+	if err != nil {
+		return false, err
+	}
+
+	return len(form.Value[key]) > 0 && re.MatchString(form.Value[key][0]), nil
+}
+
+func formFileNameIsExactly(r *http.Request, key, name string) (bool, error) {
+	return anyFormFile(r, key, func(fh *multipart.FileHeader) bool {
+		return fh.Filename == name
+	})
+}
+
+func formFileNameMatches(r *http.Request, key string, re *regexp.Regexp) (bool, error) {
+	return anyFormFile(r, key, func(fh *multipart.FileHeader) bool {
+		return re.MatchString(fh.Filename)
+	})
+}
+
+func formFileContentTypeIsExactly(r *http.Request, key, contentType string) (bool, error) {
+	return anyFormFile(r, key, func(fh *multipart.FileHeader) bool {
+		return fh.Header.Get("Content-Type") == contentType
+	})
+}
+
+func formFileContentTypeMatches(r *http.Request, key string, re *regexp.Regexp) (bool, error) {
+	return anyFormFile(r, key, func(fh *multipart.FileHeader) bool {
+		return re.MatchString(fh.Header.Get("Content-Type"))
+	})
+}
+
+func anyFormFile(r *http.Request, key string, match func(*multipart.FileHeader) bool) (bool, error) {
+	form, err := readForm(r)
+	if err != nil {
+		return false, err
+	}
+
+	for _, fh := range form.File[key] {
+		if match(fh) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// maxFormMemory is the number of bytes of multipart file parts held in
+// memory while parsing, anything beyond that is spooled to temporary files.
+const maxFormMemory = 10 << 20
+
+// readForm parses an `application/x-www-form-urlencoded` or
+// `multipart/form-data` request body without consuming it, any other (or
+// malformed) body results in an empty form.
+func readForm(r *http.Request) (*multipart.Form, error) {
+	form := &multipart.Form{
+		Value: map[string][]string{},
+		File:  map[string][]*multipart.FileHeader{},
+	}
+
+	bodyBytes, err := readBody(r)
+	if err != nil {
+		return nil, err
+	}
+
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return form, nil
+	}
+
+	switch mediaType {
+	case "application/x-www-form-urlencoded":
+		// As with http.Request.ParseForm, the pairs that could be parsed
+		// are kept even if others couldn't
+		form.Value, _ = url.ParseQuery(string(bodyBytes))
+	case "multipart/form-data":
+		parsed, err := multipart.NewReader(bytes.NewReader(bodyBytes), params["boundary"]).ReadForm(maxFormMemory)
+		if err == nil {
+			defer parsed.RemoveAll()
+			form.Value = parsed.Value
+			form.File = parsed.File
+		}
+	}
+
+	return form, nil
+}
+
+// readBody reads the whole request body and replaces it with a fresh reader
+// so that later criteria, the request store and the upstream server can
+// still read it.
+func readBody(r *http.Request) ([]byte, error) {
+	if r.Body == nil {
+		return nil, nil
+	}
+
 	defer r.Body.Close()
 	bodyBytes, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		return false, err
+		return nil, err
 	}
+
 	r.Body = ioutil.NopCloser(bytes.NewReader(bodyBytes))
-	return re.MatchString(string(bodyBytes)), nil
+	return bodyBytes, nil
 }
@@ -1,9 +1,13 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
 	"net/http"
 	"regexp"
 	"sync"
+	"text/template"
+	"time"
 
 	"github.com/satori/go.uuid"
 )
@@ -17,15 +21,41 @@ const (
 	CriteriaTypeHeader     CriteriaType = "header"
 	CriteriaTypeBody       CriteriaType = "body"
 	CriteriaTypeQueryParam CriteriaType = "query_param"
+	CriteriaTypeJSONPath   CriteriaType = "json_path"
+
+	CriteriaTypeFormField           CriteriaType = "form_field"
+	CriteriaTypeFormFileName        CriteriaType = "form_file_name"
+	CriteriaTypeFormFileContentType CriteriaType = "form_file_content_type"
+
+	CriteriaTypeAllOf  CriteriaType = "all_of"
+	CriteriaTypeAnyOf  CriteriaType = "any_of"
+	CriteriaTypeNoneOf CriteriaType = "none_of"
 )
 
 type MatchType string
 
 const (
-	MatchTypeExact MatchType = "exact"
-	MatchTypeRegex MatchType = "regex"
+	MatchTypeExact        MatchType = "exact"
+	MatchTypeRegex        MatchType = "regex"
+	MatchTypeJSONEqual    MatchType = "json_equal"
+	MatchTypeJSONContains MatchType = "json_contains"
 )
 
+// criteriaMatchTypes lists the match types supported by each type of
+// criteria, other than the all_of, any_of and none_of groups.
+var criteriaMatchTypes = map[CriteriaType][]MatchType{
+	CriteriaTypeMethod:              {MatchTypeExact},
+	CriteriaTypeHost:                {MatchTypeExact, MatchTypeRegex},
+	CriteriaTypePath:                {MatchTypeExact, MatchTypeRegex},
+	CriteriaTypeHeader:              {MatchTypeExact, MatchTypeRegex},
+	CriteriaTypeBody:                {MatchTypeExact, MatchTypeRegex, MatchTypeJSONEqual, MatchTypeJSONContains},
+	CriteriaTypeQueryParam:          {MatchTypeExact, MatchTypeRegex},
+	CriteriaTypeJSONPath:            {MatchTypeExact, MatchTypeRegex, MatchTypeJSONEqual, MatchTypeJSONContains},
+	CriteriaTypeFormField:           {MatchTypeExact, MatchTypeRegex},
+	CriteriaTypeFormFileName:        {MatchTypeExact, MatchTypeRegex},
+	CriteriaTypeFormFileContentType: {MatchTypeExact, MatchTypeRegex},
+}
+
 type BodyEncoding string
 
 const (
@@ -33,23 +63,71 @@ const (
 	BodyEncodingBase64 BodyEncoding = "base64"
 )
 
+type SequenceExhausted string
+
+const (
+	SequenceExhaustedRepeatLast  SequenceExhausted = "repeat_last"
+	SequenceExhaustedCycle       SequenceExhausted = "cycle"
+	SequenceExhaustedFallThrough SequenceExhausted = "fall_through"
+)
+
 type Request struct {
-	URL        string              `json:"url"`
-	Method     string              `json:"method"`
+	// Id is assigned by the request store, in the order requests are stored
+	Id int `json:"id,omitempty"`
+
+	URL             string              `json:"url"`
+	Method          string              `json:"method"`
+	Headers         map[string][]string `json:"headers"`
+	BodyBase64      string              `json:"body_base64"`
+	Time            time.Time           `json:"time"`
+	ExpectationUuid uuid.UUID           `json:"expectation_uuid"`
+	ClientAddr      string              `json:"client_addr,omitempty"`
+	Session         string              `json:"session,omitempty"`
+
+	// The response sent back, if any, how long it took to respond
+	// (including any delay) and for pass through requests how long the
+	// upstream server took to respond
+	Response          *Response `json:"response,omitempty"`
+	DurationMs        float64   `json:"duration_ms,omitempty"`
+	UpstreamLatencyMs float64   `json:"upstream_latency_ms,omitempty"`
+}
+
+// responded records the response sent back for the request, if there was
+// one, and how long it took to respond.
+func (r *Request) responded(resp *Response) {
+	r.Response = resp
+	r.DurationMs = float64(time.Since(r.Time)) / float64(time.Millisecond)
+}
+
+type Response struct {
+	Status     int                 `json:"status"`
 	Headers    map[string][]string `json:"headers"`
 	BodyBase64 string              `json:"body_base64"`
 }
 
 type Expectation struct {
-	RequestCriteria       Criteria    `json:"request_criteria"`
-	RespondWith           RespondWith `json:"respond_with"`
-	MaxMatches            int         `json:"max_matches"`
-	PassThrough           bool        `json:"pass_through"`
-	StoreMatchingRequests bool        `json:"store_matching_requests"`
-	Uuid                  uuid.UUID   `json:"uuid"`
+	RequestCriteria       Criteria          `json:"request_criteria"`
+	RespondWith           RespondWith       `json:"respond_with"`
+	RespondWithSequence   []RespondWith     `json:"respond_with_sequence"`
+	SequenceExhausted     SequenceExhausted `json:"sequence_exhausted"`
+	MaxMatches            int               `json:"max_matches"`
+	Priority              int               `json:"priority"`
+	PassThrough           bool              `json:"pass_through"`
+	Fault                 Fault             `json:"fault"`
+	StoreMatchingRequests bool              `json:"store_matching_requests"`
+	Uuid                  uuid.UUID         `json:"uuid"`
+	Session               string            `json:"session,omitempty"`
+
+	// TTLSeconds is turned into ExpiresAt when the expectation is created
+	TTLSeconds int        `json:"ttl_seconds,omitempty"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	Expired    bool       `json:"expired"`
 
 	Matches int `json:"matches"`
 	mutex   sync.RWMutex
+
+	// Set when loaded from -expectations-dir, and so replaced when it changes
+	source *expectationSource
 }
 
 func (e *Expectation) Match(r *http.Request) (bool, error) {
@@ -60,9 +138,56 @@ func (e *Expectation) Match(r *http.Request) (bool, error) {
 		return false, nil
 	}
 
+	if e.expiredAt(time.Now()) {
+		return false, nil
+	}
+
+	if e.SequenceExhausted == SequenceExhaustedFallThrough && len(e.RespondWithSequence) > 0 && e.Matches >= len(e.RespondWithSequence) {
+		return false, nil
+	}
+
 	return e.RequestCriteria.Match(r)
 }
 
+func (e *Expectation) expiredAt(now time.Time) bool {
+	return e.ExpiresAt != nil && !now.Before(*e.ExpiresAt)
+}
+
+type expectationFields Expectation
+
+// MarshalJSON works out `matches` and `expired` as the expectation is
+// encoded, as they change while it is being matched against.
+func (e *Expectation) MarshalJSON() ([]byte, error) {
+	e.mutex.RLock()
+	matches, expired := e.Matches, e.expiredAt(time.Now())
+	e.mutex.RUnlock()
+
+	return json.Marshal(struct {
+		*expectationFields
+		Expired bool `json:"expired"`
+		Matches int  `json:"matches"`
+	}{(*expectationFields)(e), expired, matches})
+}
+
+// responseFor returns the response for the nth (one based) match of the
+// expectation, stepping through RespondWithSequence when it has one.
+func (e *Expectation) responseFor(match int) RespondWith {
+	if len(e.RespondWithSequence) == 0 {
+		return e.RespondWith
+	}
+
+	index := match - 1
+	if index >= len(e.RespondWithSequence) {
+		if e.SequenceExhausted == SequenceExhaustedCycle {
+			index = index % len(e.RespondWithSequence)
+		} else {
+			index = len(e.RespondWithSequence) - 1
+		}
+	}
+
+	return e.RespondWithSequence[index]
+}
+
 type Criteria []*Criterion
 
 func (c Criteria) Match(r *http.Request) (bool, error) {
@@ -77,17 +202,54 @@ func (c Criteria) Match(r *http.Request) (bool, error) {
 	return true, nil
 }
 
+func (c Criteria) MatchAny(r *http.Request) (bool, error) {
+	for _, criterion := range c {
+		match, err := criterion.Match(r)
+
+		if err != nil || match {
+			return match, err
+		}
+	}
+
+	return false, nil
+}
+
 type Criterion struct {
 	Type      CriteriaType `json:"type"`
 	Key       string       `json:"key"`
 	MatchType MatchType    `json:"match_type"`
 	Value     string       `json:"value"`
 	Values    []string     `json:"values"`
+	Negate    bool         `json:"negate"`
+
+	// Criteria holds the nested criteria of the all_of, any_of and none_of types
+	Criteria Criteria `json:"criteria"`
 
-	regexp *regexp.Regexp
+	regexp    *regexp.Regexp
+	jsonPath  jsonPath
+	jsonValue interface{}
 }
 
 func (c *Criterion) Match(r *http.Request) (bool, error) {
+	match, err := c.match(r)
+	if err != nil {
+		return false, err
+	}
+
+	return match != c.Negate, nil
+}
+
+func (c *Criterion) match(r *http.Request) (bool, error) {
+	switch c.Type {
+	case CriteriaTypeAllOf:
+		return c.Criteria.Match(r)
+	case CriteriaTypeAnyOf:
+		return c.Criteria.MatchAny(r)
+	case CriteriaTypeNoneOf:
+		match, err := c.Criteria.MatchAny(r)
+		return !match, err
+	}
+
 	switch c.MatchType {
 	case MatchTypeExact:
 		switch c.Type {
@@ -107,6 +269,22 @@ func (c *Criterion) Match(r *http.Request) (bool, error) {
 			} else {
 				return queryParamIsAllOf(r, c.Key, c.Values)
 			}
+		case CriteriaTypeJSONPath:
+			if len(c.Values) == 0 {
+				return jsonPathIsExactly(r, c.jsonPath, c.Value)
+			} else {
+				return jsonPathIsAllOf(r, c.jsonPath, c.Values)
+			}
+		case CriteriaTypeFormField:
+			if len(c.Values) == 0 {
+				return formFieldIsExactly(r, c.Key, c.Value)
+			} else {
+				return formFieldIsAllOf(r, c.Key, c.Values)
+			}
+		case CriteriaTypeFormFileName:
+			return formFileNameIsExactly(r, c.Key, c.Value)
+		case CriteriaTypeFormFileContentType:
+			return formFileContentTypeIsExactly(r, c.Key, c.Value)
 		}
 
 	case MatchTypeRegex:
@@ -121,10 +299,34 @@ func (c *Criterion) Match(r *http.Request) (bool, error) {
 			return bodyMatches(r, c.regexp)
 		case CriteriaTypeQueryParam:
 			return queryParamMatches(r, c.Key, c.regexp)
+		case CriteriaTypeJSONPath:
+			return jsonPathMatches(r, c.jsonPath, c.regexp)
+		case CriteriaTypeFormField:
+			return formFieldMatches(r, c.Key, c.regexp)
+		case CriteriaTypeFormFileName:
+			return formFileNameMatches(r, c.Key, c.regexp)
+		case CriteriaTypeFormFileContentType:
+			return formFileContentTypeMatches(r, c.Key, c.regexp)
+		}
+
+	case MatchTypeJSONEqual:
+		switch c.Type {
+		case CriteriaTypeBody:
+			return bodyIsJSONEqual(r, c.jsonValue)
+		case CriteriaTypeJSONPath:
+			return jsonPathIsJSONEqual(r, c.jsonPath, c.jsonValue)
+		}
+
+	case MatchTypeJSONContains:
+		switch c.Type {
+		case CriteriaTypeBody:
+			return bodyContainsJSON(r, c.jsonValue)
+		case CriteriaTypeJSONPath:
+			return jsonPathContainsJSON(r, c.jsonPath, c.jsonValue)
 		}
 	}
 
-	return true, nil
+	return false, fmt.Errorf("match type %q is not supported by %q criteria", c.MatchType, c.Type)
 }
 
 type RespondWith struct {
@@ -132,4 +334,9 @@ type RespondWith struct {
 	Headers      map[string]string `json:"headers"`
 	Body         string            `json:"body"`
 	BodyEncoding BodyEncoding      `json:"body_encoding"`
+	Templated    bool              `json:"templated"`
+	Delay        *Delay            `json:"delay"`
+
+	bodyTemplate    *template.Template
+	headerTemplates map[string]*template.Template
 }
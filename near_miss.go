@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/satori/go.uuid"
+)
+
+// maxNearMisses is how many of the closest expectations are reported for an
+// unmatched request.
+const maxNearMisses = 3
+
+// maxActualLength truncates long actual values, such as request bodies, in
+// near miss reports.
+const maxActualLength = 256
+
+// NearMiss describes how close an expectation came to matching a request
+// that nothing matched.
+type NearMiss struct {
+	ExpectationUuid uuid.UUID  `json:"expectation_uuid"`
+	Matched         int        `json:"matched"`
+	Failed          []Mismatch `json:"failed"`
+
+	// Why an expectation whose criteria all matched didn't match anyway
+	Reason string `json:"reason,omitempty"`
+}
+
+// Mismatch is a criterion that didn't match, with the value it expected and
+// what the request actually had.
+type Mismatch struct {
+	Type      CriteriaType `json:"type"`
+	Key       string       `json:"key,omitempty"`
+	MatchType MatchType    `json:"match_type,omitempty"`
+	Negate    bool         `json:"negate,omitempty"`
+	Expected  string       `json:"expected"`
+	Actual    string       `json:"actual"`
+}
+
+func (m Mismatch) String() string {
+	name := string(m.Type)
+	if m.Key != "" {
+		name += " " + m.Key
+	}
+
+	expected := "expected"
+	if m.Negate {
+		expected = "expected not"
+	}
+
+	switch m.MatchType {
+	case MatchTypeRegex:
+		expected += " to match"
+	case MatchTypeJSONEqual:
+		expected += " to equal JSON"
+	case MatchTypeJSONContains:
+		expected += " to contain JSON"
+	}
+
+	return fmt.Sprintf("%s %s %s got %s", name, expected, m.Expected, m.Actual)
+}
+
+func (n NearMiss) String() string {
+	if n.Reason != "" {
+		return fmt.Sprintf("%s: %d criteria matched but %s", n.ExpectationUuid, n.Matched, n.Reason)
+	}
+
+	failed := make([]string, len(n.Failed))
+	for i, m := range n.Failed {
+		failed[i] = m.String()
+	}
+
+	return fmt.Sprintf("%s: %d criteria matched, %s", n.ExpectationUuid, n.Matched, strings.Join(failed, ", "))
+}
+
+// findNearMisses checks every criterion of every expectation against the
+// request and returns the closest expectations, those with the most
+// criteria matching, first. s.mutex must be held.
+func (s *Server) findNearMisses(r *http.Request, session string) ([]NearMiss, error) {
+	nearMisses := []NearMiss{}
+
+	for _, e := range s.expectations {
+		if !e.visibleTo(session) {
+			continue
+		}
+
+		nearMiss := NearMiss{ExpectationUuid: e.Uuid, Failed: []Mismatch{}}
+
+		for _, c := range e.RequestCriteria {
+			match, err := c.Match(r)
+			if err != nil {
+				return nil, err
+			}
+
+			if match {
+				nearMiss.Matched += 1
+				continue
+			}
+
+			actual, err := c.actual(r)
+			if err != nil {
+				return nil, err
+			}
+
+			nearMiss.Failed = append(nearMiss.Failed, Mismatch{
+				Type:      c.Type,
+				Key:       c.Key,
+				MatchType: c.MatchType,
+				Negate:    c.Negate,
+				Expected:  c.expected(),
+				Actual:    actual,
+			})
+		}
+
+		if nearMiss.Matched == 0 {
+			continue
+		}
+
+		if len(nearMiss.Failed) == 0 {
+			nearMiss.Reason = e.unavailableReason()
+		}
+
+		nearMisses = append(nearMisses, nearMiss)
+	}
+
+	sort.Stable(nearMissesByCloseness(nearMisses))
+
+	if len(nearMisses) > maxNearMisses {
+		nearMisses = nearMisses[:maxNearMisses]
+	}
+
+	return nearMisses, nil
+}
+
+// unavailableReason explains why an expectation doesn't match even though
+// its criteria do.
+func (e *Expectation) unavailableReason() string {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+
+	if e.MaxMatches > 0 && e.Matches >= e.MaxMatches {
+		return fmt.Sprintf("max_matches of %d reached", e.MaxMatches)
+	}
+
+	if e.expiredAt(time.Now()) {
+		return fmt.Sprintf("expired at %s", e.ExpiresAt.Format(time.RFC3339))
+	}
+
+	return "response sequence exhausted"
+}
+
+func (c *Criterion) expected() string {
+	switch c.Type {
+	case CriteriaTypeAllOf, CriteriaTypeAnyOf, CriteriaTypeNoneOf:
+		return fmt.Sprintf("%s %d criteria", c.Type, len(c.Criteria))
+	}
+
+	if len(c.Values) > 0 {
+		return quoteAll(c.Values)
+	}
+
+	return fmt.Sprintf("%q", c.Value)
+}
+
+// actual describes the part of the request the criterion looks at.
+func (c *Criterion) actual(r *http.Request) (string, error) {
+	switch c.Type {
+	case CriteriaTypeMethod:
+		return fmt.Sprintf("%q", r.Method), nil
+	case CriteriaTypeHost:
+		return fmt.Sprintf("%q", r.URL.Host), nil
+	case CriteriaTypePath:
+		return fmt.Sprintf("%q", r.URL.Path), nil
+	case CriteriaTypeHeader:
+		return quoteAll(r.Header[http.CanonicalHeaderKey(c.Key)]), nil
+	case CriteriaTypeQueryParam:
+		return quoteAll(r.URL.Query()[c.Key]), nil
+	case CriteriaTypeBody:
+		body, err := readBody(r)
+		if err != nil {
+			return "", err
+		}
+
+		return fmt.Sprintf("%q", truncate(string(body))), nil
+	case CriteriaTypeJSONPath:
+		nodes, err := selectJSONPath(r, c.jsonPath)
+		if err != nil {
+			return "", err
+		}
+
+		values := make([]string, len(nodes))
+		for i, node := range nodes {
+			values[i] = truncate(jsonNodeString(node))
+		}
+
+		return quoteAll(values), nil
+	case CriteriaTypeFormField:
+		form, err := readForm(r)
+		if err != nil {
+			return "", err
+		}
+
+		return quoteAll(form.Value[c.Key]), nil
+	case CriteriaTypeFormFileName, CriteriaTypeFormFileContentType:
+		form, err := readForm(r)
+		if err != nil {
+			return "", err
+		}
+
+		values := []string{}
+		for _, fh := range form.File[c.Key] {
+			if c.Type == CriteriaTypeFormFileName {
+				values = append(values, fh.Filename)
+			} else {
+				values = append(values, fh.Header.Get("Content-Type"))
+			}
+		}
+
+		return quoteAll(values), nil
+	}
+
+	return "a request that didn't match", nil
+}
+
+func quoteAll(values []string) string {
+	if len(values) == 0 {
+		return "nothing"
+	}
+
+	var buf bytes.Buffer
+	for i, value := range values {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+
+		fmt.Fprintf(&buf, "%q", value)
+	}
+
+	return buf.String()
+}
+
+func truncate(s string) string {
+	if len(s) <= maxActualLength {
+		return s
+	}
+
+	return s[:maxActualLength] + "..."
+}
+
+// nearMissesByCloseness sorts the expectations with the fewest failed
+// criteria first, then those with the most matched criteria.
+type nearMissesByCloseness []NearMiss
+
+func (n nearMissesByCloseness) Len() int      { return len(n) }
+func (n nearMissesByCloseness) Swap(i, j int) { n[i], n[j] = n[j], n[i] }
+func (n nearMissesByCloseness) Less(i, j int) bool {
+	if len(n[i].Failed) != len(n[j].Failed) {
+		return len(n[i].Failed) < len(n[j].Failed)
+	}
+
+	return n[i].Matched > n[j].Matched
+}
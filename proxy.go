@@ -3,58 +3,377 @@ package main
 import (
 	"bytes"
 	"encoding/base64"
-	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"log"
 	"net/http"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/elazarl/goproxy"
 )
 
+// proxyCtxData is stashed in the goproxy context by handleProxyRequest for
+// handleProxyResponse to pick up.
+type proxyCtxData struct {
+	request     *http.Request
+	requestBody []byte
+	record      bool
+
+	// The pass through request, whose journal entry (and stored request, if
+	// its expectation stores matching requests) gets the response once it
+	// arrives, and when it was sent upstream
+	proxied  Request
+	sequence int
+	store    bool
+	sent     time.Time
+
+	event Event
+}
+
 func (s *Server) handleProxyRequest(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	// The context is shared by every request in a MITM'd HTTPS connection
+	ctx.UserData = nil
+	ctx.RoundTripper = nil
+
+	session := s.requestSession(r)
+	r.Header.Del(s.sessionHeaderName())
+
+	request, err := newStoredRequest(r)
+	if err != nil {
+		return r, goproxy.NewResponse(r, goproxy.ContentTypeText, http.StatusBadGateway, fmt.Sprintf("everdeen: %s", err))
+	}
+
+	request.Session = session
+
+	// Don't hold the lock for the rest of the request, responses may be delayed
 	s.mutex.RLock()
-	defer s.mutex.RUnlock()
+	expectation, err := s.findMatchingExpectation(r, session)
+	s.mutex.RUnlock()
 
-	expectation, err := s.findMatchingExpectation(r)
 	if err != nil {
 		return r, goproxy.NewResponse(r, goproxy.ContentTypeText, http.StatusBadGateway, fmt.Sprintf("everdeen: %s", err))
 	}
 
+	var fault Fault
+	if expectation != nil {
+		request.ExpectationUuid = expectation.Uuid
+		fault = expectation.Fault
+	}
+
+	entry := s.journal.Add(JournalEntry{Request: request, Fault: fault})
+
 	if expectation == nil {
-		return r, goproxy.NewResponse(r, goproxy.ContentTypeText, http.StatusNotFound, fmt.Sprintf("everdeen: no expectation matched request"))
+		return r, s.unmatchedResponse(r, request, entry.Sequence)
 	} else {
 		expectation.mutex.Lock()
 		expectation.Matches += 1
+		match := expectation.Matches
 		expectation.mutex.Unlock()
 
-		if expectation.PassThrough {
+		s.notifier.notify()
+
+		rw := expectation.responseFor(match)
+		time.Sleep(rw.Delay.Duration())
+
+		event := newEvent(request)
+
+		if expectation.Fault != FaultNone {
+			request.responded(nil)
+			s.journal.Responded(entry.Sequence, request)
+
+			if expectation.StoreMatchingRequests {
+				if err := s.store().Save(&request); err != nil {
+					log.Printf("ERROR: storing request: %v", err)
+				}
+			}
+
+			event.Fault = expectation.Fault
+			s.publishEvent(event)
+
+			return s.injectFault(r, expectation.Fault, rw)
+		} else if expectation.PassThrough {
+			event.PassThrough = true
+
+			// Stored now in case the upstream server can't be reached, the
+			// response is added once it arrives
+			if expectation.StoreMatchingRequests {
+				if err := s.store().Save(&request); err != nil {
+					log.Printf("ERROR: storing request: %v", err)
+				}
+			}
+
+			data := &proxyCtxData{
+				proxied:  request,
+				sequence: entry.Sequence,
+				store:    expectation.StoreMatchingRequests,
+				sent:     time.Now(),
+				event:    event,
+			}
+
+			if s.recorder.Enabled() {
+				body, err := readBody(r)
+				if err != nil {
+					return r, goproxy.NewResponse(r, goproxy.ContentTypeText, http.StatusBadGateway, fmt.Sprintf("everdeen: %s", err))
+				}
+
+				data.request, data.requestBody, data.record = r, body, true
+			}
+
+			ctx.UserData = data
+			ctx.RoundTripper = goproxy.RoundTripperFunc(s.passThroughRoundTrip)
+
 			return r, nil
 		} else {
-			return proxyRespond(r, expectation.RespondWith)
+			req, resp := proxyRespond(r, rw)
+
+			response, err := newStoredResponse(resp)
+			if err == nil {
+				request.responded(response)
+
+				if expectation.StoreMatchingRequests {
+					err = s.store().Save(&request)
+				}
+			}
+
+			if err != nil {
+				resp = goproxy.NewResponse(r, goproxy.ContentTypeText, http.StatusBadGateway, fmt.Sprintf("everdeen: %s", err))
+				req = r
+
+				response, _ = newStoredResponse(resp)
+				request.responded(response)
+			}
+
+			s.journal.Responded(entry.Sequence, request)
+
+			event.Status = resp.StatusCode
+			s.publishEvent(event)
+
+			return req, resp
 		}
 	}
 }
 
-func (s *Server) findMatchingExpectation(r *http.Request) (*Expectation, error) {
+// unmatchedResponse records a request no expectation matched, along with
+// its near misses and the 404 it's responded to with.
+func (s *Server) unmatchedResponse(r *http.Request, request Request, sequence int) *http.Response {
+	entry := JournalEntry{}
+
+	var err error
+
+	s.mutex.RLock()
+	entry.NearMisses, err = s.findNearMisses(r, request.Session)
+	s.mutex.RUnlock()
+
+	if err != nil {
+		log.Printf("ERROR: finding near misses: %v", err)
+	}
+
+	body := "everdeen: no expectation matched request"
+
+	if s.nearMissesInResponse && len(entry.NearMisses) > 0 {
+		body += "\n\nClosest expectations:"
+		for _, nearMiss := range entry.NearMisses {
+			body += "\n  " + nearMiss.String()
+		}
+	}
+
+	resp := goproxy.NewResponse(r, goproxy.ContentTypeText, http.StatusNotFound, body)
+
+	request.responded(&Response{
+		Status:     resp.StatusCode,
+		Headers:    cloneHeader(resp.Header),
+		BodyBase64: base64.StdEncoding.EncodeToString([]byte(body)),
+	})
+
+	s.journal.Responded(sequence, request)
+
+	entry.Request = request
+	s.unmatched.Add(entry)
+	s.notifier.notify()
+
+	event := newEvent(request)
+	event.Status = resp.StatusCode
+	s.publishEvent(event)
+
+	return resp
+}
+
+func (s *Server) handleProxyResponse(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	data, ok := ctx.UserData.(*proxyCtxData)
+	if !ok {
+		return resp
+	}
+
+	ctx.UserData = nil
+
+	latency := float64(time.Since(data.sent)) / float64(time.Millisecond)
+	data.proxied.UpstreamLatencyMs = latency
+	data.event.UpstreamLatencyMs = latency
+
+	// Upstream errors leave the request without a response
+	if resp == nil {
+		s.finishPassThrough(data, nil, nil)
+		return resp
+	}
+
+	data.event.Status = resp.StatusCode
+	s.publishEvent(data.event)
+
+	// goproxy changes the headers of MITM'd responses as it sends them on
+	response := &Response{Status: resp.StatusCode, Headers: cloneHeader(resp.Header)}
+
+	// Stored and recorded responses are read in full, the rest are streamed
+	// on to the client and journaled once they've been read
+	if !data.store && !data.record {
+		resp.Body = &capturingBody{
+			ReadCloser: resp.Body,
+			done: func(body []byte) {
+				s.finishPassThrough(data, response, body)
+			},
+		}
+
+		return resp
+	}
+
+	body, err := readResponseBody(resp)
+	if err != nil {
+		log.Printf("ERROR: reading proxied response: %v", err)
+	}
+
+	s.finishPassThrough(data, response, body)
+
+	if data.record && err == nil {
+		s.recorder.Record(data.request, data.requestBody, resp, body)
+	}
+
+	return resp
+}
+
+// passThroughRoundTrip sends a pass through request upstream. goproxy
+// doesn't call the response handlers of MITM'd requests whose upstream
+// server can't be reached, so they're finished off here instead.
+func (s *Server) passThroughRoundTrip(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Response, error) {
+	resp, err := s.Proxy.Tr.RoundTrip(req)
+	if err != nil {
+		if data, ok := ctx.UserData.(*proxyCtxData); ok {
+			ctx.UserData = nil
+
+			data.proxied.UpstreamLatencyMs = float64(time.Since(data.sent)) / float64(time.Millisecond)
+			s.finishPassThrough(data, nil, nil)
+		}
+	}
+
+	return resp, err
+}
+
+// finishPassThrough records the response to a pass through request, if
+// there was one, on its journal entry and stored request. Requests without
+// a response haven't had their event published yet.
+func (s *Server) finishPassThrough(data *proxyCtxData, response *Response, body []byte) {
+	request := data.proxied
+
+	if response != nil {
+		response.BodyBase64 = base64.StdEncoding.EncodeToString(body)
+	} else {
+		data.event.UpstreamLatencyMs = request.UpstreamLatencyMs
+		s.publishEvent(data.event)
+	}
+
+	request.responded(response)
+	s.journal.Responded(data.sequence, request)
+
+	if data.store {
+		if err := s.store().Update(request); err != nil {
+			log.Printf("ERROR: storing request: %v", err)
+		}
+	}
+}
+
+// maxJournaledBodySize is how much of a streamed pass through response body
+// is kept for the journal.
+const maxJournaledBodySize = 1 << 20
+
+// capturingBody keeps a copy of the start of a response body as it's read,
+// calling done with it once the body has been read or closed.
+type capturingBody struct {
+	io.ReadCloser
+
+	buf  bytes.Buffer
+	done func(body []byte)
+	once sync.Once
+}
+
+func (b *capturingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+
+	if keep := maxJournaledBodySize - b.buf.Len(); keep > 0 {
+		if keep > n {
+			keep = n
+		}
+
+		b.buf.Write(p[:keep])
+	}
+
+	if err == io.EOF {
+		b.finish()
+	}
+
+	return n, err
+}
+
+func (b *capturingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.finish()
+
+	return err
+}
+
+func (b *capturingBody) finish() {
+	b.once.Do(func() {
+		b.done(b.buf.Bytes())
+	})
+}
+
+// findMatchingExpectation picks the highest priority expectation matching
+// the request out of those visible to the session. Ties are broken by
+// preferring the session's own expectations to global ones, and then the
+// oldest (or with s.newestFirst, the newest) expectation.
+func (s *Server) findMatchingExpectation(r *http.Request, session string) (*Expectation, error) {
+	var found *Expectation
+
 	for _, e := range s.expectations {
+		if !e.visibleTo(session) || (found != nil && !s.preferred(e, found)) {
+			continue
+		}
+
 		match, err := e.Match(r)
 		if err != nil {
 			return nil, err
 		}
 
 		if match {
-			if e.StoreMatchingRequests {
-				if err := s.requestStore.Save(e.Uuid, r); err != nil {
-					return nil, errors.New(fmt.Sprintf("everdeen: %s", err))
-				}
-			}
-			return e, nil
+			found = e
 		}
 	}
 
-	return nil, nil
+	return found, nil
+}
+
+// preferred reports whether a matching expectation takes precedence over
+// an older one that also matched.
+func (s *Server) preferred(e, older *Expectation) bool {
+	if e.Priority != older.Priority {
+		return e.Priority > older.Priority
+	}
+
+	if (e.Session == "") != (older.Session == "") {
+		return e.Session != ""
+	}
+
+	return s.newestFirst
 }
 
 func proxyRespond(r *http.Request, rw RespondWith) (*http.Request, *http.Response) {
@@ -63,7 +382,18 @@ func proxyRespond(r *http.Request, rw RespondWith) (*http.Request, *http.Respons
 	resp.TransferEncoding = r.TransferEncoding
 	resp.Header = make(http.Header)
 
-	for key, value := range rw.Headers {
+	headers, body := rw.Headers, rw.Body
+
+	if rw.Templated {
+		var err error
+		headers, body, err = renderRespondWith(r, rw)
+
+		if err != nil {
+			return nil, goproxy.NewResponse(r, goproxy.ContentTypeText, http.StatusInternalServerError, fmt.Sprintf("everdeen: error rendering response template: %s", err))
+		}
+	}
+
+	for key, value := range headers {
 		resp.Header.Add(key, value)
 	}
 
@@ -72,7 +402,7 @@ func proxyRespond(r *http.Request, rw RespondWith) (*http.Request, *http.Respons
 	var bodyReader io.Reader
 
 	if rw.BodyEncoding == BodyEncodingBase64 {
-		bodyBytes, err := base64.StdEncoding.DecodeString(rw.Body)
+		bodyBytes, err := base64.StdEncoding.DecodeString(body)
 
 		if err == nil {
 			bodyReader = bytes.NewReader(bodyBytes)
@@ -83,7 +413,7 @@ func proxyRespond(r *http.Request, rw RespondWith) (*http.Request, *http.Respons
 
 		resp.ContentLength = int64(len(bodyBytes))
 	} else {
-		buf := bytes.NewBufferString(rw.Body)
+		buf := bytes.NewBufferString(body)
 		resp.ContentLength = int64(buf.Len())
 		bodyReader = buf
 	}
@@ -91,3 +421,20 @@ func proxyRespond(r *http.Request, rw RespondWith) (*http.Request, *http.Respons
 	resp.Body = ioutil.NopCloser(bodyReader)
 	return nil, resp
 }
+
+// readResponseBody reads the whole response body and replaces it with a
+// fresh reader so it can still be sent on to the client.
+func readResponseBody(resp *http.Response) ([]byte, error) {
+	if resp.Body == nil {
+		return nil, nil
+	}
+
+	defer resp.Body.Close()
+	bodyBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	resp.Body = ioutil.NopCloser(bytes.NewReader(bodyBytes))
+	return bodyBytes, nil
+}
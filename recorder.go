@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"unicode/utf8"
+)
+
+// Recorder captures pass through traffic as expectations, so that fixtures
+// for a new integration can be recorded against the real service and then
+// loaded with `POST /expectations`.
+type Recorder struct {
+	enabled      bool
+	expectations []Expectation
+	keys         []string
+	mutex        sync.RWMutex
+}
+
+// hopByHopHeaders aren't meaningful in a recorded response, everdeen works
+// out the framing of the responses it sends itself.
+var hopByHopHeaders = map[string]bool{
+	"Connection":        true,
+	"Content-Length":    true,
+	"Keep-Alive":        true,
+	"Proxy-Connection":  true,
+	"Transfer-Encoding": true,
+	"Upgrade":           true,
+}
+
+func (rec *Recorder) Enabled() bool {
+	rec.mutex.RLock()
+	defer rec.mutex.RUnlock()
+
+	return rec.enabled
+}
+
+func (rec *Recorder) SetEnabled(enabled bool) {
+	rec.mutex.Lock()
+	defer rec.mutex.Unlock()
+
+	rec.enabled = enabled
+}
+
+// Record adds an expectation matching the request and responding with the
+// response. Recording the same request again adds the response to the
+// existing expectation's respond_with_sequence so replaying it responds in
+// the same order.
+func (rec *Recorder) Record(r *http.Request, requestBody []byte, resp *http.Response, responseBody []byte) {
+	rec.mutex.Lock()
+	defer rec.mutex.Unlock()
+
+	if !rec.enabled {
+		return
+	}
+
+	rw := recordedResponse(resp, responseBody)
+	key := r.Method + " " + r.URL.String() + "\n" + string(requestBody)
+
+	for i := range rec.keys {
+		if rec.keys[i] != key {
+			continue
+		}
+
+		e := &rec.expectations[i]
+		if len(e.RespondWithSequence) == 0 {
+			e.RespondWithSequence = []RespondWith{e.RespondWith}
+		}
+
+		e.RespondWithSequence = append(e.RespondWithSequence, rw)
+		return
+	}
+
+	rec.keys = append(rec.keys, key)
+	rec.expectations = append(rec.expectations, Expectation{
+		RequestCriteria: recordedCriteria(r, requestBody),
+		RespondWith:     rw,
+	})
+}
+
+func (rec *Recorder) Reset() {
+	rec.mutex.Lock()
+	defer rec.mutex.Unlock()
+
+	rec.keys = nil
+	rec.expectations = nil
+}
+
+// Export writes the recorded expectations in the shape accepted by
+// `POST /expectations`.
+func (rec *Recorder) Export(w http.ResponseWriter) error {
+	rec.mutex.RLock()
+	defer rec.mutex.RUnlock()
+
+	request := CreateExpectationsRequest{Expectations: rec.expectations}
+	if request.Expectations == nil {
+		request.Expectations = []Expectation{}
+	}
+
+	return json.NewEncoder(w).Encode(request)
+}
+
+func recordedCriteria(r *http.Request, body []byte) Criteria {
+	criteria := Criteria{
+		{Type: CriteriaTypeMethod, MatchType: MatchTypeExact, Value: r.Method},
+		{Type: CriteriaTypeHost, MatchType: MatchTypeExact, Value: r.URL.Host},
+		{Type: CriteriaTypePath, MatchType: MatchTypeExact, Value: r.URL.Path},
+	}
+
+	query := r.URL.Query()
+
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		criteria = append(criteria, &Criterion{
+			Type:      CriteriaTypeQueryParam,
+			Key:       key,
+			MatchType: MatchTypeExact,
+			Values:    query[key],
+		})
+	}
+
+	if len(body) > 0 && utf8.Valid(body) {
+		criterion := &Criterion{Type: CriteriaTypeBody, MatchType: MatchTypeExact, Value: string(body)}
+
+		if _, err := decodeJSON(body); err == nil {
+			criterion.MatchType = MatchTypeJSONEqual
+		}
+
+		criteria = append(criteria, criterion)
+	}
+
+	return criteria
+}
+
+func recordedResponse(resp *http.Response, body []byte) RespondWith {
+	rw := RespondWith{
+		Status:  resp.StatusCode,
+		Headers: map[string]string{},
+	}
+
+	for key, values := range resp.Header {
+		if !hopByHopHeaders[http.CanonicalHeaderKey(key)] && len(values) > 0 {
+			rw.Headers[key] = values[0]
+		}
+	}
+
+	if utf8.Valid(body) {
+		rw.Body = string(body)
+	} else {
+		rw.Body = base64.StdEncoding.EncodeToString(body)
+		rw.BodyEncoding = BodyEncodingBase64
+	}
+
+	return rw
+}
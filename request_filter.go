@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type SortOrder string
+
+const (
+	SortOrderAsc  SortOrder = "asc"
+	SortOrderDesc SortOrder = "desc"
+)
+
+// RequestFilter narrows down and pages through the stored requests of an
+// expectation, from the query parameters of GET /expectations/{uuid}/requests.
+type RequestFilter struct {
+	From    time.Time
+	To      time.Time
+	Method  string
+	Path    string
+	Headers map[string]string
+
+	SinceId int
+	Offset  int
+	Limit   int
+	Sort    SortOrder
+}
+
+// parseRequestFilter reads a filter from the query parameters. Headers are
+// given as `header=Name: value`, or just `header=Name` for any value.
+func parseRequestFilter(query url.Values) (RequestFilter, error) {
+	filter := RequestFilter{
+		Method:  strings.ToUpper(query.Get("method")),
+		Path:    query.Get("path"),
+		Headers: map[string]string{},
+		Sort:    SortOrder(query.Get("sort")),
+	}
+
+	for _, param := range []struct {
+		name  string
+		value *time.Time
+	}{
+		{"from", &filter.From},
+		{"to", &filter.To},
+	} {
+		if v := query.Get(param.name); v != "" {
+			t, err := time.Parse(time.RFC3339Nano, v)
+			if err != nil {
+				return filter, fmt.Errorf("invalid %s %q, expected an RFC 3339 time", param.name, v)
+			}
+
+			*param.value = t
+		}
+	}
+
+	for _, param := range []struct {
+		name  string
+		value *int
+	}{
+		{"since_id", &filter.SinceId},
+		{"offset", &filter.Offset},
+		{"limit", &filter.Limit},
+	} {
+		if v := query.Get(param.name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return filter, fmt.Errorf("invalid %s %q, expected a non-negative number", param.name, v)
+			}
+
+			*param.value = n
+		}
+	}
+
+	for _, header := range query["header"] {
+		parts := strings.SplitN(header, ":", 2)
+		key := textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(parts[0]))
+
+		if len(parts) == 2 {
+			filter.Headers[key] = strings.TrimSpace(parts[1])
+		} else {
+			filter.Headers[key] = ""
+		}
+	}
+
+	switch filter.Sort {
+	case "":
+		filter.Sort = SortOrderAsc
+	case SortOrderAsc, SortOrderDesc:
+	default:
+		return filter, fmt.Errorf("invalid sort %q, expected asc or desc", filter.Sort)
+	}
+
+	return filter, nil
+}
+
+// Apply returns the requests passing the filter, in its sort order, after
+// skipping Offset of them and returning at most Limit. The requests are
+// expected oldest first.
+func (f RequestFilter) Apply(requests []Request) []Request {
+	found := []Request{}
+
+	for _, request := range requests {
+		if f.match(request) {
+			found = append(found, request)
+		}
+	}
+
+	if f.Sort == SortOrderDesc {
+		for i, j := 0, len(found)-1; i < j; i, j = i+1, j-1 {
+			found[i], found[j] = found[j], found[i]
+		}
+	}
+
+	if f.Offset >= len(found) {
+		return []Request{}
+	}
+
+	found = found[f.Offset:]
+
+	if f.Limit > 0 && f.Limit < len(found) {
+		found = found[:f.Limit]
+	}
+
+	return found
+}
+
+func (f RequestFilter) match(request Request) bool {
+	if request.Id <= f.SinceId {
+		return false
+	}
+
+	if !f.From.IsZero() && request.Time.Before(f.From) {
+		return false
+	}
+
+	if !f.To.IsZero() && request.Time.After(f.To) {
+		return false
+	}
+
+	if f.Method != "" && request.Method != f.Method {
+		return false
+	}
+
+	if f.Path != "" {
+		u, err := url.Parse(request.URL)
+		if err != nil || u.Path != f.Path {
+			return false
+		}
+	}
+
+	for key, value := range f.Headers {
+		if !headerHasValue(request.Headers[key], value) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// headerHasValue reports whether a header is set to the value, or is set at
+// all when the value is empty.
+func headerHasValue(values []string, value string) bool {
+	if value == "" {
+		return len(values) > 0
+	}
+
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRequestFilter(t *testing.T) {
+	start := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	requests := []Request{
+		{Id: 1, Method: "GET", URL: "http://example.com/a", Time: start},
+		{Id: 2, Method: "POST", URL: "http://example.com/b?c=d", Time: start.Add(time.Minute), Headers: map[string][]string{"X-Test": {"yes"}}},
+		{Id: 3, Method: "GET", URL: "http://example.com/b", Time: start.Add(2 * time.Minute), Headers: map[string][]string{"X-Test": {"no"}}},
+		{Id: 4, Method: "GET", URL: "http://example.com/a", Time: start.Add(3 * time.Minute)},
+	}
+
+	for query, expected := range map[string][]int{
+		"":                                 {1, 2, 3, 4},
+		"method=get":                       {1, 3, 4},
+		"path=/b":                          {2, 3},
+		"header=X-Test":                    {2, 3},
+		"header=x-test:+yes":               {2},
+		"from=2017-06-01T12:01:00Z":        {2, 3, 4},
+		"to=2017-06-01T12:01:30Z":          {1, 2},
+		"since_id=2":                       {3, 4},
+		"sort=desc":                        {4, 3, 2, 1},
+		"limit=2":                          {1, 2},
+		"offset=1&limit=2":                 {2, 3},
+		"offset=10":                        {},
+		"sort=desc&limit=1":                {4},
+		"method=GET&path=/a&since_id=1":    {4},
+		"sort=desc&since_id=1&offset=1":    {3, 2},
+		"from=2017-06-01T12:00:30Z&to=now": nil,
+	} {
+		values, err := url.ParseQuery(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		filter, err := parseRequestFilter(values)
+		if expected == nil {
+			if err == nil {
+				t.Errorf("expected an error parsing %q but got none", query)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("unexpected error parsing %q: %s", query, err)
+			continue
+		}
+
+		ids := []int{}
+		for _, request := range filter.Apply(requests) {
+			ids = append(ids, request.Id)
+		}
+
+		if !reflect.DeepEqual(ids, expected) {
+			t.Errorf("expected requests %v for %q but got %v", expected, query, ids)
+		}
+	}
+
+	for _, query := range []string{"limit=-1", "offset=x", "since_id=1.5", "sort=random", "from=yesterday"} {
+		values, _ := url.ParseQuery(query)
+		if _, err := parseRequestFilter(values); err == nil {
+			t.Errorf("expected an error parsing %q but got none", query)
+		}
+	}
+
+	values, _ := url.ParseQuery("offset=0")
+	if _, err := parseRequestFilter(values); err != nil {
+		t.Errorf("expected an offset of 0 to be accepted, got: %v", err)
+	}
+
+	values, _ = url.ParseQuery("limit=-1")
+	if _, err := parseRequestFilter(values); err == nil || !strings.Contains(err.Error(), "non-negative") {
+		t.Errorf("expected the error to ask for a non-negative number, got: %v", err)
+	}
+}
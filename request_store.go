@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bytes"
 	"encoding/base64"
 	"encoding/json"
 	"io/ioutil"
@@ -9,68 +8,122 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"sync"
+	"time"
 
 	"github.com/satori/go.uuid"
 )
 
-type RequestStore struct {
+// RequestStore keeps the requests matching expectations which have
+// StoreMatchingRequests set.
+type RequestStore interface {
+	// Save stores the request, setting its Id
+	Save(request *Request) error
+
+	// Update replaces a stored request, by its Id, unless it's since been
+	// deleted
+	Update(request Request) error
+
+	Where(expUuid uuid.UUID) ([]Request, error)
+	All() ([]Request, error)
+	Delete(expUuid uuid.UUID) error
+	Reset() error
+}
+
+// FileRequestStore keeps each request as a JSON file, in a directory per
+// expectation under -request-base-store.
+type FileRequestStore struct {
 	requestCount int
 	mutex        sync.RWMutex
 }
 
-func (rs *RequestStore) Save(expUuid uuid.UUID, r *http.Request) error {
+func (rs *FileRequestStore) Save(request *Request) error {
 	rs.mutex.Lock()
 	defer rs.mutex.Unlock()
 
 	rs.requestCount += 1
+	request.Id = rs.requestCount
 
 	//Ensure directories exist
-	expPath := path.Join(*requestBaseStore, expUuid.String())
-	newFileName := strconv.Itoa(rs.requestCount) + ".json"
+	expPath := path.Join(*requestBaseStore, request.ExpectationUuid.String())
 	os.MkdirAll(expPath, 0744)
 
-	var b []byte
-	var err error
+	return writeRequestFile(expPath, *request)
+}
 
-	if r.Body != nil {
-		defer r.Body.Close()
+func (rs *FileRequestStore) Update(request Request) error {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
 
-		b, err = ioutil.ReadAll(r.Body)
-		if err != nil {
-			return err
-		}
-		r.Body = ioutil.NopCloser(bytes.NewReader(b))
+	expPath := path.Join(*requestBaseStore, request.ExpectationUuid.String())
+	if _, err := os.Stat(requestFileName(expPath, request)); os.IsNotExist(err) {
+		return nil
 	}
 
-	request := Request{
-		URL:        r.URL.String(),
-		Method:     r.Method,
-		Headers:    r.Header,
-		BodyBase64: base64.StdEncoding.EncodeToString(b),
-	}
+	return writeRequestFile(expPath, request)
+}
+
+func requestFileName(expPath string, request Request) string {
+	return filepath.Join(expPath, strconv.Itoa(request.Id)+".json")
+}
 
+func writeRequestFile(expPath string, request Request) error {
 	reqJson, err := json.Marshal(&request)
 	if err != nil {
 		return err
 	}
 
-	err = ioutil.WriteFile(filepath.Join(expPath, newFileName), reqJson, 0644)
+	return ioutil.WriteFile(requestFileName(expPath, request), reqJson, 0644)
+}
+
+func (rs *FileRequestStore) Where(expUuid uuid.UUID) ([]Request, error) {
+	rs.mutex.RLock()
+	defer rs.mutex.RUnlock()
+
+	found, err := readRequestDir(path.Join(*requestBaseStore, expUuid.String()), []Request{})
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	// Files are listed by name, so 10.json comes before 2.json
+	sort.Sort(requestsById(found))
+
+	return found, nil
 }
 
-func (rs *RequestStore) Where(expUuid uuid.UUID) ([]Request, error) {
+// All returns the stored requests of every expectation, in the order they
+// were stored.
+func (rs *FileRequestStore) All() ([]Request, error) {
 	rs.mutex.RLock()
 	defer rs.mutex.RUnlock()
 
 	found := []Request{}
 
-	basePath := path.Join(*requestBaseStore, expUuid.String())
+	dirs, err := ioutil.ReadDir(*requestBaseStore)
+	if err != nil {
+		return found, nil
+	}
+
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+
+		if found, err = readRequestDir(path.Join(*requestBaseStore, dir.Name()), found); err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Sort(requestsById(found))
+
+	return found, nil
+}
+
+// readRequestDir appends the requests stored in an expectation's directory
+// to found.
+func readRequestDir(basePath string, found []Request) ([]Request, error) {
 	files, err := ioutil.ReadDir(basePath)
 	if err != nil {
 		// If the expectation directory doesn't exist should return empty array
@@ -97,12 +150,257 @@ func (rs *RequestStore) Where(expUuid uuid.UUID) ([]Request, error) {
 	return found, nil
 }
 
+// Delete removes the stored requests of an expectation.
+func (rs *FileRequestStore) Delete(expUuid uuid.UUID) error {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+
+	return os.RemoveAll(path.Join(*requestBaseStore, expUuid.String()))
+}
+
+func (rs *FileRequestStore) Reset() error {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+
+	return os.RemoveAll(*requestBaseStore)
+}
+
+// MemoryRequestStore keeps requests in memory, dropping the oldest requests
+// once they take up more than maxBytes.
+type MemoryRequestStore struct {
+	requests map[uuid.UUID][]Request
+	order    []uuid.UUID
+	lastId   int
+	size     int
+	maxBytes int
+	mutex    sync.RWMutex
+}
+
+func NewMemoryRequestStore(maxBytes int) *MemoryRequestStore {
+	return &MemoryRequestStore{
+		requests: map[uuid.UUID][]Request{},
+		maxBytes: maxBytes,
+	}
+}
+
+func (rs *MemoryRequestStore) Save(request *Request) error {
+	expUuid := request.ExpectationUuid
+
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+
+	rs.lastId += 1
+	request.Id = rs.lastId
+
+	rs.requests[expUuid] = append(rs.requests[expUuid], *request)
+	rs.order = append(rs.order, expUuid)
+	rs.size += requestSize(*request)
+
+	rs.trim()
+
+	return nil
+}
+
+func (rs *MemoryRequestStore) Update(request Request) error {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+
+	requests := rs.requests[request.ExpectationUuid]
+	for i := range requests {
+		if requests[i].Id == request.Id {
+			rs.size += requestSize(request) - requestSize(requests[i])
+			requests[i] = request
+			rs.trim()
+			break
+		}
+	}
+
+	return nil
+}
+
+func (rs *MemoryRequestStore) trim() {
+	// Requests are stored in order, so the oldest request is the first one
+	// of the expectation at the front of the queue
+	for rs.maxBytes > 0 && rs.size > rs.maxBytes && len(rs.order) > 0 {
+		oldest := rs.order[0]
+		rs.order = rs.order[1:]
+
+		if requests := rs.requests[oldest]; len(requests) > 0 {
+			rs.size -= requestSize(requests[0])
+			rs.requests[oldest] = requests[1:]
+		}
+	}
+}
+
+func (rs *MemoryRequestStore) Where(expUuid uuid.UUID) ([]Request, error) {
+	rs.mutex.RLock()
+	defer rs.mutex.RUnlock()
+
+	return append([]Request{}, rs.requests[expUuid]...), nil
+}
+
+func (rs *MemoryRequestStore) All() ([]Request, error) {
+	rs.mutex.RLock()
+	defer rs.mutex.RUnlock()
+
+	found := []Request{}
+	for _, requests := range rs.requests {
+		found = append(found, requests...)
+	}
+
+	sort.Sort(requestsById(found))
+
+	return found, nil
+}
+
+func (rs *MemoryRequestStore) Delete(expUuid uuid.UUID) error {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+
+	for _, request := range rs.requests[expUuid] {
+		rs.size -= requestSize(request)
+	}
+
+	delete(rs.requests, expUuid)
+
+	order := rs.order[:0]
+	for _, u := range rs.order {
+		if !uuid.Equal(u, expUuid) {
+			order = append(order, u)
+		}
+	}
+	rs.order = order
+
+	return nil
+}
+
+func (rs *MemoryRequestStore) Reset() error {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+
+	rs.requests = map[uuid.UUID][]Request{}
+	rs.order = nil
+	rs.size = 0
+
+	return nil
+}
+
+type requestsById []Request
+
+func (r requestsById) Len() int           { return len(r) }
+func (r requestsById) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r requestsById) Less(i, j int) bool { return r[i].Id < r[j].Id }
+
+// requestSize roughly estimates the memory taken up by a stored request.
+func requestSize(r Request) int {
+	size := len(r.URL) + len(r.Method) + len(r.BodyBase64) + len(r.ClientAddr) + headersSize(r.Headers)
+	if r.Response != nil {
+		size += len(r.Response.BodyBase64) + headersSize(r.Response.Headers)
+	}
+
+	return size
+}
+
+func headersSize(headers map[string][]string) int {
+	size := 0
+	for key, values := range headers {
+		size += len(key)
+		for _, value := range values {
+			size += len(value)
+		}
+	}
+
+	return size
+}
+
+// newStoredRequest captures the request as it was received.
+func newStoredRequest(r *http.Request) (Request, error) {
+	b, err := readBody(r)
+	if err != nil {
+		return Request{}, err
+	}
+
+	// The proxy credentials name the session, they're not sent upstream
+	// so shouldn't be shown either
+	headers := cloneHeader(r.Header)
+	delete(headers, "Proxy-Authorization")
+
+	return Request{
+		URL:        r.URL.String(),
+		Method:     r.Method,
+		Headers:    headers,
+		BodyBase64: base64.StdEncoding.EncodeToString(b),
+		Time:       time.Now().UTC(),
+		ClientAddr: r.RemoteAddr,
+	}, nil
+}
+
+// newStoredResponse captures the response sent back for a request.
+func newStoredResponse(resp *http.Response) (*Response, error) {
+	b, err := readResponseBody(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Response{
+		Status:     resp.StatusCode,
+		Headers:    cloneHeader(resp.Header),
+		BodyBase64: base64.StdEncoding.EncodeToString(b),
+	}, nil
+}
+
+// cloneHeader copies headers, goproxy changes those of requests it passes on.
+func cloneHeader(header http.Header) map[string][]string {
+	clone := make(map[string][]string, len(header))
+	for key, values := range header {
+		clone[key] = append([]string{}, values...)
+	}
+
+	return clone
+}
+
+// deleteStoredRequests deletes the stored requests of removed expectations.
+// It's called without s.mutex held, as the file store deletes from disk.
+func (s *Server) deleteStoredRequests(expUuids []uuid.UUID) error {
+	for _, expUuid := range expUuids {
+		if err := s.store().Delete(expUuid); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// store returns the server's request store, which defaults to a
+// FileRequestStore.
+func (s *Server) store() RequestStore {
+	s.storeOnce.Do(func() {
+		if s.requestStore == nil {
+			s.requestStore = &FileRequestStore{}
+		}
+	})
+
+	return s.requestStore
+}
+
 func (s *Server) findExpectationByUuid(expUuid uuid.UUID) *Expectation {
-	for _, exp := range s.expectations {
+	if i := s.expectationIndex(expUuid); i != -1 {
+		return s.expectations[i]
+	}
+
+	return nil
+}
+
+func (s *Server) expectationIndex(expUuid uuid.UUID) int {
+	if uuid.Equal(expUuid, uuid.Nil) {
+		return -1
+	}
+
+	for i, exp := range s.expectations {
 		if uuid.Equal(exp.Uuid, expUuid) {
-			return exp
+			return i
 		}
 	}
 
-	return nil
+	return -1
 }
@@ -9,9 +9,27 @@ import (
 	"github.com/satori/go.uuid"
 )
 
+func saveRequest(store RequestStore, expUuid uuid.UUID, r *http.Request) error {
+	request, err := newStoredRequest(r)
+	if err != nil {
+		return err
+	}
+
+	request.ExpectationUuid = expUuid
+	return store.Save(&request)
+}
+
 func TestRequestStore(t *testing.T) {
-	store := RequestStore{}
+	for name, store := range map[string]RequestStore{
+		"file":   &FileRequestStore{},
+		"memory": NewMemoryRequestStore(0),
+	} {
+		t.Logf("testing the %s request store", name)
+		testRequestStore(t, store)
+	}
+}
 
+func testRequestStore(t *testing.T, store RequestStore) {
 	expUuid := uuid.NewV4()
 
 	buildAndStore := func(method, path string, body string) *http.Request {
@@ -20,7 +38,7 @@ func TestRequestStore(t *testing.T) {
 			t.Fatal(err)
 		}
 
-		if err := store.Save(expUuid, req); err != nil {
+		if err := saveRequest(store, expUuid, req); err != nil {
 			t.Fatal(err)
 		}
 
@@ -36,7 +54,7 @@ func TestRequestStore(t *testing.T) {
 	}
 
 	if len(found) != 0 {
-		t.Errorf("expected 0 requests to be found, but got: %d", found)
+		t.Errorf("expected 0 requests to be found, but got: %d", len(found))
 	}
 
 	found, err = store.Where(expUuid)
@@ -45,7 +63,7 @@ func TestRequestStore(t *testing.T) {
 	}
 
 	if len(found) != 2 {
-		t.Errorf("expected %d requests to be found, got: %d", 2, found)
+		t.Errorf("expected %d requests to be found, got: %d", 2, len(found))
 	}
 
 	if get.URL.String() != found[0].URL {
@@ -65,4 +83,90 @@ func TestRequestStore(t *testing.T) {
 	if reflect.DeepEqual(expectedReq, found[1]) {
 		t.Errorf("Expected request %+v to match %+v but it didn't", expectedReq, found[1])
 	}
+
+	otherUuid := uuid.NewV4()
+	if err := saveRequest(store, otherUuid, get); err != nil {
+		t.Fatal(err)
+	}
+
+	all, err := store.All()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(all) != 3 || all[0].URL != get.URL.String() || !uuid.Equal(all[2].ExpectationUuid, otherUuid) {
+		t.Errorf("expected every stored request in order, got: %+v", all)
+	}
+
+	updated := all[2]
+	updated.Response = &Response{Status: http.StatusOK}
+	if err := store.Update(updated); err != nil {
+		t.Fatal(err)
+	}
+
+	if found, _ := store.Where(otherUuid); len(found) != 1 || found[0].Response == nil || found[0].Response.Status != http.StatusOK {
+		t.Errorf("expected the stored request to be updated, got: %+v", found)
+	}
+
+	if err := store.Delete(expUuid); err != nil {
+		t.Fatal(err)
+	}
+
+	if found, _ := store.Where(expUuid); len(found) != 0 {
+		t.Errorf("expected 0 requests after deleting them, got: %d", len(found))
+	}
+
+	if err := store.Update(all[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	if found, _ := store.Where(expUuid); len(found) != 0 {
+		t.Errorf("expected updating a deleted request not to store it again, got: %d", len(found))
+	}
+
+	if found, _ := store.Where(otherUuid); len(found) != 1 {
+		t.Errorf("expected requests of other expectations to be kept, got: %d", len(found))
+	}
+
+	if err := store.Reset(); err != nil {
+		t.Fatal(err)
+	}
+
+	if found, _ := store.Where(otherUuid); len(found) != 0 {
+		t.Errorf("expected 0 requests after a reset, got: %d", len(found))
+	}
+}
+
+func TestMemoryRequestStoreLimit(t *testing.T) {
+	build := func(path string) *http.Request {
+		req, err := http.NewRequest("POST", path, strings.NewReader(strings.Repeat("x", 100)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return req
+	}
+
+	size := requestSize(Request{URL: "/a", Method: "POST", BodyBase64: strings.Repeat("x", 136)})
+	store := NewMemoryRequestStore(3 * size)
+
+	uuidA, uuidB := uuid.NewV4(), uuid.NewV4()
+
+	for _, save := range []struct {
+		expUuid uuid.UUID
+		path    string
+	}{
+		{uuidA, "/a"}, {uuidB, "/b"}, {uuidA, "/c"}, {uuidB, "/d"},
+	} {
+		if err := saveRequest(store, save.expUuid, build(save.path)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	foundA, _ := store.Where(uuidA)
+	foundB, _ := store.Where(uuidB)
+
+	if len(foundA) != 1 || foundA[0].URL != "/c" || len(foundB) != 2 {
+		t.Errorf("expected the oldest request to be dropped, got: %+v and %+v", foundA, foundB)
+	}
 }
@@ -15,13 +15,16 @@ module Everdeen
       JSON.parse(response)
     end
 
-    def requests(expectation_uuid)
-      response = Net::HTTP.get build_uri("/expectations/#{expectation_uuid}/requests")
-      JSON.parse(response)
+    def requests(expectation_uuid, filters = {})
+      uri = build_uri("/expectations/#{expectation_uuid}/requests")
+      uri.query = URI.encode_www_form(filters) unless filters.empty?
+
+      JSON.parse(Net::HTTP.get(uri))
     end
 
-    def create_expectations(expectations)
+    def create_expectations(expectations, session: nil)
       uri = build_uri('/expectations')
+      uri.query = URI.encode_www_form(session: session) if session
 
       request = Net::HTTP::Post.new(uri, { 'Content-Type' => 'application/json' })
       request.body = {
@@ -33,6 +36,41 @@ module Everdeen
       end
     end
 
+    def expectation(uuid)
+      response = Net::HTTP.get build_uri("/expectations/#{uuid}")
+      JSON.parse(response)
+    end
+
+    def update_expectation(uuid, attributes)
+      uri = build_uri("/expectations/#{uuid}")
+
+      request = Net::HTTP::Patch.new(uri, { 'Content-Type' => 'application/json' })
+      request.body = attributes.to_json
+
+      Net::HTTP.start(uri.host, uri.port) do |http|
+        JSON.parse(http.request(request).body)
+      end
+    end
+
+    def delete_expectation(uuid, delete_requests: false)
+      uri = build_uri("/expectations/#{uuid}")
+      uri.query = 'delete_requests=true' if delete_requests
+      req = Net::HTTP::Delete.new(uri)
+
+      Net::HTTP.start(uri.host, uri.port) { |http| http.request(req) }
+    end
+
+    def create_session
+      JSON.parse(post('/sessions').body)['id']
+    end
+
+    def delete_session(session)
+      uri = build_uri("/sessions/#{session}")
+      req = Net::HTTP::Delete.new(uri.path)
+
+      Net::HTTP.start(uri.host, uri.port) { |http| http.request(req) }
+    end
+
     def reset_all
       uri = build_uri('/reset/all')
       req = Net::HTTP::Delete.new(uri.path)
@@ -40,8 +78,94 @@ module Everdeen
       Net::HTTP.start(uri.host, uri.port) { |http| http.request(req) }
     end
 
+    def unmatched_requests
+      response = Net::HTTP.get build_uri('/requests/unmatched')
+      JSON.parse(response)['requests']
+    end
+
+    def reset_unmatched_requests
+      uri = build_uri('/requests/unmatched')
+      req = Net::HTTP::Delete.new(uri.path)
+
+      Net::HTTP.start(uri.host, uri.port) { |http| http.request(req) }
+    end
+
+    def verify(verifications)
+      response = post('/verify', verifications: verifications)
+      JSON.parse(response.body)
+    end
+
+    def verify_order(expectation_uuids)
+      response = post('/verify/order', expectation_uuids: expectation_uuids)
+      JSON.parse(response.body)
+    end
+
+    def wait(verification)
+      response = post('/wait', verification)
+      JSON.parse(response.body)
+    end
+
+    def har(filters = {})
+      uri = build_uri('/har')
+      uri.query = URI.encode_www_form(filters) unless filters.empty?
+
+      JSON.parse(Net::HTTP.get(uri))
+    end
+
+    # Yields each event from the stream until the block breaks out of it
+    def events(filters = {})
+      uri = build_uri('/events')
+      uri.query = URI.encode_www_form(filters) unless filters.empty?
+
+      Net::HTTP.start(uri.host, uri.port, read_timeout: nil) do |http|
+        http.request(Net::HTTP::Get.new(uri)) do |response|
+          buffer = ''
+
+          response.read_body do |chunk|
+            buffer << chunk
+
+            while (index = buffer.index("\n\n"))
+              message = buffer.slice!(0, index + 2)
+              data = message.lines.find { |line| line.start_with?('data: ') }
+
+              yield JSON.parse(data.sub('data: ', '')) if data
+            end
+          end
+        end
+      end
+    end
+
+    def start_recording
+      post('/recordings/start')
+    end
+
+    def stop_recording
+      post('/recordings/stop')
+    end
+
+    def recordings
+      response = Net::HTTP.get build_uri('/recordings')
+      JSON.parse(response)
+    end
+
+    def reset_recordings
+      uri = build_uri('/recordings')
+      req = Net::HTTP::Delete.new(uri.path)
+
+      Net::HTTP.start(uri.host, uri.port) { |http| http.request(req) }
+    end
+
     private
 
+    def post(path, body = nil)
+      uri = build_uri(path)
+
+      request = Net::HTTP::Post.new(uri, { 'Content-Type' => 'application/json' })
+      request.body = body.to_json if body
+
+      Net::HTTP.start(uri.host, uri.port) { |http| http.request(request) }
+    end
+
     def build_uri(path)
       uri = control_addr.dup
       uri.path = path
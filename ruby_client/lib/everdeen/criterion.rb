@@ -1,6 +1,6 @@
 module Everdeen
   class Criterion
-    attr_reader :key, :type, :value
+    attr_reader :key, :type, :value, :negate
 
     def initialize(args = {})
       args.each do |key, value|
@@ -12,10 +12,18 @@ module Everdeen
       @match_type || 'exact'
     end
 
+    def criteria
+      Array(@criteria).map { |criterion| criterion.is_a?(Criterion) ? criterion : Criterion.new(criterion) }
+    end
+
+    MULTI_VALUE_TYPES = %w(query_param json_path form_field).freeze
+
     def to_hash
       base = { key: key, match_type: match_type, type: type }
+      base[:negate] = true if negate
+      base[:criteria] = criteria.map(&:to_hash) if @criteria
 
-      if query_param_type? && value.is_a?(Array)
+      if multi_value_type? && value.is_a?(Array)
         base.merge(values: value)
       else
         base.merge(value: value)
@@ -24,8 +32,8 @@ module Everdeen
 
     private
 
-    def query_param_type?
-      type == 'query_param'
+    def multi_value_type?
+      MULTI_VALUE_TYPES.include?(type.to_s)
     end
   end
 end
@@ -1,15 +1,16 @@
 module Everdeen
   class Expectation
-    attr_reader :uuid, :max_matches, :response, :request_criteria
+    attr_reader :uuid, :max_matches, :priority, :ttl_seconds, :expires_at, :response, :request_criteria, :response_sequence, :sequence_exhausted
 
     def initialize(args = {})
       args.each do |key, value|
-        next if ['response', 'request_criteria'].include?(key.to_s)
+        next if ['response', 'request_criteria', 'response_sequence', 'respond_with_sequence'].include?(key.to_s)
         instance_variable_set("@#{key}", value)
       end
 
       add_response(args[:response] || args['response'])
       add_request(args[:request_criteria] || args['request_criteria'])
+      add_response_sequence(args[:response_sequence] || args['respond_with_sequence'])
     end
 
     def pass_through
@@ -21,13 +22,21 @@ module Everdeen
     end
 
     def to_hash
-      {
+      base = {
         store_matching_requests: store_matching_requests,
         max_matches: max_matches,
         pass_through: pass_through,
         request_criteria: request_criteria.to_hash,
         respond_with: response.to_hash
       }
+
+      base[:respond_with_sequence] = response_sequence.map(&:to_hash) if response_sequence.any?
+      base[:sequence_exhausted] = sequence_exhausted if sequence_exhausted
+      base[:fault] = @fault if @fault
+      base[:priority] = priority if priority
+      base[:ttl_seconds] = ttl_seconds if ttl_seconds
+      base[:expires_at] = expires_at if expires_at
+      base
     end
 
     private
@@ -36,6 +45,10 @@ module Everdeen
       @response = Response.new(response_attr)
     end
 
+    def add_response_sequence(responses_attrs)
+      @response_sequence = Array(responses_attrs).map { |attrs| Response.new(attrs) }
+    end
+
     def add_request(request_attrs)
       @request_criteria = RequestCriteria.new(request_attrs)
     end
@@ -2,13 +2,22 @@ require 'base64'
 
 module Everdeen
   class Request
-    attr_reader :body_base64, :headers, :method, :url
+    attr_reader :id, :body_base64, :headers, :method, :url, :time, :expectation_uuid,
+                :client_addr, :session, :response, :duration_ms, :upstream_latency_ms
 
     def initialize(args = {})
+      @id = args['id']
       @body_base64 = args['body_base64']
       @headers = args['headers']
       @method = args['method']
       @url = args['url']
+      @time = args['time']
+      @expectation_uuid = args['expectation_uuid']
+      @client_addr = args['client_addr']
+      @session = args['session']
+      @response = args['response']
+      @duration_ms = args['duration_ms']
+      @upstream_latency_ms = args['upstream_latency_ms']
     end
 
     def body
@@ -1,6 +1,6 @@
 module Everdeen
   class Response
-    attr_reader :status, :headers, :body
+    attr_reader :status, :headers, :body, :delay
 
     def initialize(args = {})
       Hash(args).each do |key, value|
@@ -12,13 +12,21 @@ module Everdeen
       @body_encoding.to_s
     end
 
+    def templated
+      !!@templated
+    end
+
     def to_hash
-      {
+      base = {
         status: status,
         headers: headers,
         body: body,
         body_encoding: body_encoding
       }
+
+      base[:templated] = true if templated
+      base[:delay] = delay if delay
+      base
     end
   end
 end
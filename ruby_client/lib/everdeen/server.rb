@@ -26,22 +26,86 @@ module Everdeen
       pid
     end
 
-    def create_expectations(expectations)
-      client.create_expectations(expectations).collect { |exp| Expectation.new(exp) }
+    def create_expectations(expectations, session: nil)
+      client.create_expectations(expectations, session: session).collect { |exp| Expectation.new(exp) }
     end
 
     def registered_expectations
       client.registered_expectations
     end
 
-    def requests(expectation_id)
-      client.requests(expectation_id)['requests'].collect { |req| Request.new(req) }
+    def requests(expectation_id, filters = {})
+      client.requests(expectation_id, filters)['requests'].collect { |req| Request.new(req) }
+    end
+
+    def expectation(uuid)
+      client.expectation(uuid)
+    end
+
+    def update_expectation(uuid, attributes)
+      client.update_expectation(uuid, attributes)
+    end
+
+    def delete_expectation(uuid, delete_requests: false)
+      client.delete_expectation(uuid, delete_requests: delete_requests)
+    end
+
+    def create_session
+      client.create_session
+    end
+
+    def delete_session(session)
+      client.delete_session(session)
     end
 
     def reset_all
       client.reset_all
     end
 
+    def unmatched_requests
+      client.unmatched_requests
+    end
+
+    def reset_unmatched_requests
+      client.reset_unmatched_requests
+    end
+
+    def verify(verifications)
+      client.verify(verifications)
+    end
+
+    def verify_order(expectation_uuids)
+      client.verify_order(expectation_uuids)
+    end
+
+    def wait(verification)
+      client.wait(verification)
+    end
+
+    def har(filters = {})
+      client.har(filters)
+    end
+
+    def events(filters = {}, &block)
+      client.events(filters, &block)
+    end
+
+    def start_recording
+      client.start_recording
+    end
+
+    def stop_recording
+      client.stop_recording
+    end
+
+    def recordings
+      client.recordings
+    end
+
+    def reset_recordings
+      client.reset_recordings
+    end
+
     def stop
       Process.kill(:INT, @pipe.pid)
     end
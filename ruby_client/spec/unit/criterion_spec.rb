@@ -57,6 +57,40 @@ module Everdeen
           })
         end
       end
+
+      describe 'groups' do
+        let(:criterion) do
+          Everdeen::Criterion.new(
+            type: 'any_of',
+            negate: true,
+            criteria: [{ type: 'host', value: 'www.geckoboard.com' }]
+          )
+        end
+
+        it 'returns the nested criteria and negate flag' do
+          expect(criterion.to_hash).to eq({
+            key: nil,
+            match_type: 'exact',
+            type: 'any_of',
+            value: nil,
+            negate: true,
+            criteria: [{ key: nil, match_type: 'exact', type: 'host', value: 'www.geckoboard.com' }]
+          })
+        end
+      end
+
+      describe 'form_field' do
+        let(:criterion) { Everdeen::Criterion.new(type: :form_field, key: 'scope', value: ['read', 'write']) }
+
+        it 'returns values as the user array' do
+          expect(criterion.to_hash).to eq({
+            key: 'scope',
+            match_type: 'exact',
+            type: :form_field,
+            values: ['read', 'write']
+          })
+        end
+      end
     end
   end
 end
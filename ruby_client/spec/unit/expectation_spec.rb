@@ -98,6 +98,30 @@ module Everdeen
           respond_with: response.to_hash
         )
       end
+
+      it 'includes the response sequence when given' do
+        subject = Expectation.new(
+          response_sequence: [{ status: 503 }, { status: 200 }],
+          sequence_exhausted: 'cycle'
+        )
+
+        expect(subject.to_hash).to include(
+          respond_with_sequence: [Response.new(status: 503).to_hash, Response.new(status: 200).to_hash],
+          sequence_exhausted: 'cycle'
+        )
+      end
+
+      it 'includes the priority when given' do
+        subject = Expectation.new(priority: 10)
+
+        expect(subject.to_hash).to include(priority: 10)
+      end
+
+      it 'includes the expiry when given' do
+        subject = Expectation.new(ttl_seconds: 300)
+
+        expect(subject.to_hash).to include(ttl_seconds: 300)
+      end
     end
   end
 end
@@ -45,6 +45,18 @@ module Everdeen
           body_encoding: 'base64'
         )
       end
+
+      it 'includes templated when set' do
+        subject = Response.new(status: 200, body: '{{ .Query.Get "id" }}', templated: true)
+
+        expect(subject.to_hash).to eq(
+          status: 200,
+          headers: nil,
+          body: '{{ .Query.Get "id" }}',
+          body_encoding: '',
+          templated: true
+        )
+      end
     end
   end
 end
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/satori/go.uuid"
+)
+
+// defaultSessionHeader is the header proxied requests name their session
+// in, unless -session-header says otherwise.
+const defaultSessionHeader = "X-Everdeen-Session"
+
+type SessionResponse struct {
+	Id string `json:"id"`
+}
+
+func (s *Server) sessionHeaderName() string {
+	if s.sessionHeader == "" {
+		return defaultSessionHeader
+	}
+
+	return s.sessionHeader
+}
+
+// requestSession works out which session a proxied request belongs to, from
+// the session header, the username of its proxy credentials or, for
+// requests read from a MITM'd HTTPS tunnel, the proxy credentials of the
+// CONNECT request that opened the tunnel.
+func (s *Server) requestSession(r *http.Request) string {
+	if session := s.directSession(r); session != "" {
+		return session
+	}
+
+	if _, tunnel := s.conns.find(r.RemoteAddr); tunnel != nil && r.URL.Scheme == "https" {
+		return tunnel.session
+	}
+
+	return ""
+}
+
+func (s *Server) directSession(r *http.Request) string {
+	if session := r.Header.Get(s.sessionHeaderName()); session != "" {
+		return session
+	}
+
+	return proxyAuthUsername(r)
+}
+
+func proxyAuthUsername(r *http.Request) string {
+	auth := r.Header.Get("Proxy-Authorization")
+	if auth == "" {
+		return ""
+	}
+
+	// http.Request.BasicAuth only reads the Authorization header
+	req := &http.Request{Header: http.Header{"Authorization": {auth}}}
+	username, _, _ := req.BasicAuth()
+
+	return username
+}
+
+// visibleTo reports whether an expectation applies to requests in the
+// session, expectations without a session apply to every session.
+func (e *Expectation) visibleTo(session string) bool {
+	return e.Session == "" || e.Session == session
+}
+
+// sessionParam reads the session the control API request is scoped to from
+// the `session` query parameter, responding with a 404 for unknown sessions.
+func (s *Server) sessionParam(w http.ResponseWriter, r *http.Request) (string, bool) {
+	session := r.URL.Query().Get("session")
+
+	s.mutex.RLock()
+	known := s.sessions[session]
+	s.mutex.RUnlock()
+
+	if session != "" && !known {
+		http.Error(w, fmt.Sprintf("everdeen: unknown session %q", session), http.StatusNotFound)
+		return "", false
+	}
+
+	return session, true
+}
+
+func (s *Server) createSession(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+
+	if s.sessions == nil {
+		s.sessions = map[string]bool{}
+	}
+
+	session := uuid.NewV4().String()
+	s.sessions[session] = true
+
+	s.mutex.Unlock()
+
+	if err := json.NewEncoder(w).Encode(SessionResponse{Id: session}); err != nil {
+		http.Error(w, fmt.Sprintf("everdeen: %s", err), http.StatusInternalServerError)
+		log.Printf("ERROR: %v", err)
+	}
+}
+
+// deleteSession removes a session along with its expectations, their stored
+// requests and its journaled requests.
+func (s *Server) deleteSession(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+
+	session := strings.TrimPrefix(r.URL.Path, "/sessions/")
+	if !s.sessions[session] {
+		s.mutex.Unlock()
+		http.Error(w, fmt.Sprintf("everdeen: unknown session %q", session), http.StatusNotFound)
+		return
+	}
+
+	removed := s.resetSession(session)
+	delete(s.sessions, session)
+
+	s.mutex.Unlock()
+
+	if err := s.deleteStoredRequests(removed); err != nil {
+		http.Error(w, fmt.Sprintf("everdeen: %s", err), http.StatusInternalServerError)
+		log.Printf("ERROR: %v", err)
+		return
+	}
+
+	io.WriteString(w, "OK")
+}
+
+// resetSession removes the expectations and journaled requests of a
+// session, returning the UUIDs of the removed expectations so that their
+// stored requests can be deleted once s.mutex, which must be held, is
+// released.
+func (s *Server) resetSession(session string) []uuid.UUID {
+	expectations := make([]*Expectation, 0, len(s.expectations))
+	removed := []uuid.UUID{}
+
+	for _, e := range s.expectations {
+		if e.Session != session {
+			expectations = append(expectations, e)
+			continue
+		}
+
+		removed = append(removed, e.Uuid)
+	}
+
+	s.expectations = expectations
+
+	inSession := func(entry JournalEntry) bool {
+		return entry.Session == session
+	}
+
+	s.journal.Remove(inSession)
+	s.unmatched.Remove(inSession)
+
+	return removed
+}
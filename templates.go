@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/satori/go.uuid"
+)
+
+var templateFuncs = template.FuncMap{
+	"uuid": func() string {
+		return uuid.NewV4().String()
+	},
+	"now": func(layout ...string) string {
+		if len(layout) > 0 {
+			return time.Now().UTC().Format(layout[0])
+		}
+
+		return time.Now().UTC().Format(time.RFC3339)
+	},
+	"unixTime": func() int64 {
+		return time.Now().Unix()
+	},
+}
+
+// templateData is what response templates are executed with, it exposes the
+// parts of the incoming request, e.g. `{{ .Query.Get "id" }}`,
+// `{{ .PathSegment 1 }}` or `{{ .JSONPath "$.customer.id" }}`.
+type templateData struct {
+	Method       string
+	URL          string
+	Host         string
+	Path         string
+	PathSegments []string
+	Query        url.Values
+	Headers      http.Header
+	Body         string
+}
+
+func newTemplateData(r *http.Request) (*templateData, error) {
+	bodyBytes, err := readBody(r)
+	if err != nil {
+		return nil, err
+	}
+
+	segments := []string{}
+	for _, segment := range strings.Split(r.URL.Path, "/") {
+		if segment != "" {
+			segments = append(segments, segment)
+		}
+	}
+
+	return &templateData{
+		Method:       r.Method,
+		URL:          r.URL.String(),
+		Host:         r.URL.Host,
+		Path:         r.URL.Path,
+		PathSegments: segments,
+		Query:        r.URL.Query(),
+		Headers:      r.Header,
+		Body:         string(bodyBytes),
+	}, nil
+}
+
+// PathSegment returns the nth (zero based) segment of the request path, or
+// an empty string if the path is shorter than that.
+func (d *templateData) PathSegment(n int) string {
+	if n < 0 || n >= len(d.PathSegments) {
+		return ""
+	}
+
+	return d.PathSegments[n]
+}
+
+// JSONPath returns the first node selected by expr from the request body,
+// or an empty string if the body isn't JSON or nothing was selected.
+func (d *templateData) JSONPath(expr string) (string, error) {
+	path, err := compileJSONPath(expr)
+	if err != nil {
+		return "", err
+	}
+
+	doc, err := decodeJSON([]byte(d.Body))
+	if err != nil {
+		return "", nil
+	}
+
+	nodes := path.Select(doc)
+	if len(nodes) == 0 {
+		return "", nil
+	}
+
+	return jsonNodeString(nodes[0]), nil
+}
+
+// renderRespondWith executes the body and header templates of a templated
+// response against the request.
+func renderRespondWith(r *http.Request, rw RespondWith) (map[string]string, string, error) {
+	data, err := newTemplateData(r)
+	if err != nil {
+		return nil, "", err
+	}
+
+	headers := make(map[string]string, len(rw.headerTemplates))
+	for key, t := range rw.headerTemplates {
+		if headers[key], err = renderTemplate(t, data); err != nil {
+			return nil, "", err
+		}
+	}
+
+	body, err := renderTemplate(rw.bodyTemplate, data)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return headers, body, nil
+}
+
+func parseResponseTemplate(name, text string) (*template.Template, error) {
+	return template.New(name).Funcs(templateFuncs).Parse(text)
+}
+
+func renderTemplate(t *template.Template, data *templateData) (string, error) {
+	var buf bytes.Buffer
+
+	if err := t.Execute(&buf, data); err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/satori/go.uuid"
+)
+
+type VerifyRequest struct {
+	Verifications []Verification `json:"verifications"`
+}
+
+// Verification checks how many times a registered expectation has matched,
+// or how many journaled requests match inline criteria. Without any counts
+// it checks for at least one.
+type Verification struct {
+	ExpectationUuid uuid.UUID `json:"expectation_uuid"`
+	RequestCriteria Criteria  `json:"request_criteria"`
+
+	AtLeast *int `json:"at_least,omitempty"`
+	AtMost  *int `json:"at_most,omitempty"`
+	Exactly *int `json:"exactly,omitempty"`
+}
+
+type VerificationResult struct {
+	Verification
+	Count   int    `json:"count"`
+	Passed  bool   `json:"passed"`
+	Message string `json:"message,omitempty"`
+}
+
+type VerifyResponse struct {
+	Passed  bool                 `json:"passed"`
+	Results []VerificationResult `json:"results"`
+}
+
+func (v *Verification) prepare() error {
+	hasUuid := !uuid.Equal(v.ExpectationUuid, uuid.Nil)
+
+	if hasUuid == (len(v.RequestCriteria) > 0) {
+		return errors.New("verifications need either an expectation_uuid or request_criteria")
+	}
+
+	for _, count := range []*int{v.AtLeast, v.AtMost, v.Exactly} {
+		if count != nil && *count < 0 {
+			return errors.New("verification counts cannot be negative")
+		}
+	}
+
+	if v.Exactly != nil && (v.AtLeast != nil || v.AtMost != nil) {
+		return errors.New("exactly cannot be combined with at_least or at_most")
+	}
+
+	if v.AtLeast == nil && v.AtMost == nil && v.Exactly == nil {
+		one := 1
+		v.AtLeast = &one
+	}
+
+	if hasUuid {
+		return nil
+	}
+
+	return prepareCriteria(v.RequestCriteria)
+}
+
+// check compares the count against the bounds of the verification,
+// describing how it failed if it did.
+func (v *Verification) check(count int) (bool, string) {
+	switch {
+	case v.Exactly != nil && count != *v.Exactly:
+		return false, fmt.Sprintf("expected exactly %d matching requests, got %d", *v.Exactly, count)
+	case v.AtLeast != nil && count < *v.AtLeast:
+		return false, fmt.Sprintf("expected at least %d matching requests, got %d", *v.AtLeast, count)
+	case v.AtMost != nil && count > *v.AtMost:
+		return false, fmt.Sprintf("expected at most %d matching requests, got %d", *v.AtMost, count)
+	}
+
+	return true, ""
+}
+
+func (s *Server) verify(w http.ResponseWriter, r *http.Request) {
+	session, ok := s.sessionParam(w, r)
+	if !ok {
+		return
+	}
+
+	var request VerifyRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, fmt.Sprintf("everdeen: %s", err), http.StatusBadRequest)
+		log.Printf("ERROR: %v", err)
+		return
+	}
+
+	for i := range request.Verifications {
+		if err := request.Verifications[i].prepare(); err != nil {
+			http.Error(w, fmt.Sprintf("everdeen: %s", err), http.StatusBadRequest)
+			log.Printf("ERROR: %v", err)
+			return
+		}
+	}
+
+	response := VerifyResponse{Passed: true, Results: []VerificationResult{}}
+
+	for _, v := range request.Verifications {
+		result := VerificationResult{Verification: v}
+
+		count, err := s.verificationCount(v, session)
+		if err != nil {
+			result.Message = err.Error()
+		} else {
+			result.Count = count
+			result.Passed, result.Message = v.check(count)
+		}
+
+		response.Passed = response.Passed && result.Passed
+		response.Results = append(response.Results, result)
+	}
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		http.Error(w, fmt.Sprintf("everdeen: %s", err), http.StatusInternalServerError)
+		log.Printf("ERROR: %v", err)
+	}
+}
+
+// verificationCount counts the matches of the expectation, or the requests
+// in the session's journal matching the criteria.
+func (s *Server) verificationCount(v Verification, session string) (int, error) {
+	if !uuid.Equal(v.ExpectationUuid, uuid.Nil) {
+		s.mutex.RLock()
+		exp := s.findExpectationByUuid(v.ExpectationUuid)
+		s.mutex.RUnlock()
+
+		if exp == nil {
+			return 0, fmt.Errorf("expectation %s not found", v.ExpectationUuid)
+		}
+
+		exp.mutex.RLock()
+		defer exp.mutex.RUnlock()
+
+		return exp.Matches, nil
+	}
+
+	count := 0
+
+	for _, entry := range s.journal.SessionEntries(session) {
+		match, err := v.matchesEntry(entry)
+		if err != nil {
+			return 0, err
+		}
+
+		if match {
+			count += 1
+		}
+	}
+
+	return count, nil
+}
+
+func (v Verification) matchesEntry(entry JournalEntry) (bool, error) {
+	req, err := entry.httpRequest()
+	if err != nil {
+		return false, err
+	}
+
+	return v.RequestCriteria.Match(req)
+}
+
+type VerifyOrderRequest struct {
+	ExpectationUuids []uuid.UUID `json:"expectation_uuids"`
+}
+
+type VerifyOrderResponse struct {
+	Passed  bool   `json:"passed"`
+	Message string `json:"message,omitempty"`
+
+	// The journal entries of the in order matches, up to the first failure
+	Matches []JournalEntry `json:"matches"`
+}
+
+// verifyOrder checks the expectations were matched in the given order, by
+// finding each one in the journal after the match of the one before it.
+func (s *Server) verifyOrder(w http.ResponseWriter, r *http.Request) {
+	session, ok := s.sessionParam(w, r)
+	if !ok {
+		return
+	}
+
+	var request VerifyOrderRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, fmt.Sprintf("everdeen: %s", err), http.StatusBadRequest)
+		log.Printf("ERROR: %v", err)
+		return
+	}
+
+	if len(request.ExpectationUuids) == 0 {
+		http.Error(w, "everdeen: expectation_uuids must contain at least one expectation", http.StatusBadRequest)
+		return
+	}
+
+	response := VerifyOrderResponse{
+		Passed:  true,
+		Matches: []JournalEntry{},
+	}
+
+	response.Passed, response.Message = checkOrder(s.journal.SessionEntries(session), request.ExpectationUuids, &response.Matches)
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		http.Error(w, fmt.Sprintf("everdeen: %s", err), http.StatusInternalServerError)
+		log.Printf("ERROR: %v", err)
+	}
+}
+
+func checkOrder(entries []JournalEntry, expUuids []uuid.UUID, matches *[]JournalEntry) (bool, string) {
+	next := 0
+
+	for i, expUuid := range expUuids {
+		found := false
+
+		for next < len(entries) {
+			entry := entries[next]
+			next += 1
+
+			if uuid.Equal(entry.ExpectationUuid, expUuid) {
+				*matches = append(*matches, entry)
+				found = true
+				break
+			}
+		}
+
+		if found {
+			continue
+		}
+
+		if i == 0 {
+			return false, fmt.Sprintf("expectation %s was never matched", expUuid)
+		}
+
+		for _, entry := range entries {
+			if uuid.Equal(entry.ExpectationUuid, expUuid) {
+				return false, fmt.Sprintf("expectation %s was matched out of order, not after expectation %s", expUuid, expUuids[i-1])
+			}
+		}
+
+		return false, fmt.Sprintf("expectation %s was never matched", expUuid)
+	}
+
+	return true, ""
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/satori/go.uuid"
+)
+
+const defaultWaitTimeout = 30 * time.Second
+
+// WaitRequest waits for a verification to pass, for up to TimeoutMs.
+type WaitRequest struct {
+	Verification
+	TimeoutMs int `json:"timeout_ms"`
+}
+
+type WaitResponse struct {
+	Passed  bool   `json:"passed"`
+	Count   int    `json:"count"`
+	Message string `json:"message,omitempty"`
+}
+
+// requestNotifier wakes up everyone waiting on it each time the proxy
+// receives a request.
+type requestNotifier struct {
+	ch    chan struct{}
+	mutex sync.Mutex
+}
+
+// wait returns a channel that's closed on the next notify.
+func (n *requestNotifier) wait() <-chan struct{} {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if n.ch == nil {
+		n.ch = make(chan struct{})
+	}
+
+	return n.ch
+}
+
+func (n *requestNotifier) notify() {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if n.ch != nil {
+		close(n.ch)
+		n.ch = nil
+	}
+}
+
+func (s *Server) wait(w http.ResponseWriter, r *http.Request) {
+	session, ok := s.sessionParam(w, r)
+	if !ok {
+		return
+	}
+
+	var request WaitRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, fmt.Sprintf("everdeen: %s", err), http.StatusBadRequest)
+		log.Printf("ERROR: %v", err)
+		return
+	}
+
+	err := request.prepare()
+	if err == nil && request.TimeoutMs < 0 {
+		err = errors.New("timeout_ms cannot be negative")
+	}
+
+	if err != nil {
+		http.Error(w, fmt.Sprintf("everdeen: %s", err), http.StatusBadRequest)
+		log.Printf("ERROR: %v", err)
+		return
+	}
+
+	timeout := defaultWaitTimeout
+	if request.TimeoutMs > 0 {
+		timeout = time.Duration(request.TimeoutMs) * time.Millisecond
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	var closed <-chan bool
+	if notifier, ok := w.(http.CloseNotifier); ok {
+		closed = notifier.CloseNotify()
+	}
+
+	var response WaitResponse
+	var count, seen int
+
+	for {
+		// Start listening before counting so requests in between aren't missed
+		notified := s.notifier.wait()
+
+		count, seen, err = s.waitCount(request.Verification, session, count, seen)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("everdeen: %s", err), http.StatusNotFound)
+			log.Printf("ERROR: %v", err)
+			return
+		}
+
+		response.Count = count
+		if response.Passed, response.Message = request.check(count); response.Passed {
+			break
+		}
+
+		select {
+		case <-notified:
+			continue
+		case <-closed:
+			return
+		case <-timer.C:
+		}
+
+		response.Message = fmt.Sprintf("timed out after %s, %s", timeout, response.Message)
+		break
+	}
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		http.Error(w, fmt.Sprintf("everdeen: %s", err), http.StatusInternalServerError)
+		log.Printf("ERROR: %v", err)
+	}
+}
+
+// waitCount brings the count of requests matching a verification up to
+// date, only looking at the journal entries after the last one seen rather
+// than recounting the whole journal on every request.
+func (s *Server) waitCount(v Verification, session string, count, seen int) (int, int, error) {
+	if !uuid.Equal(v.ExpectationUuid, uuid.Nil) {
+		count, err := s.verificationCount(v, session)
+		return count, seen, err
+	}
+
+	for _, entry := range s.journal.EntriesSince(seen) {
+		seen = entry.Sequence
+
+		if session != "" && entry.Session != session {
+			continue
+		}
+
+		match, err := v.matchesEntry(entry)
+		if err != nil {
+			return count, seen, err
+		}
+
+		if match {
+			count += 1
+		}
+	}
+
+	return count, seen, nil
+}